@@ -17,7 +17,15 @@
 package common
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
 	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dominant-strategies/go-quai/log"
@@ -25,7 +33,11 @@ import (
 )
 
 const (
-	MantBits = 64
+	// EntropyScaleBits is the number of fractional bits used by the big-bits
+	// fixed point representation of entropy, i.e. entropy is scaled by
+	// 2^EntropyScaleBits.
+	EntropyScaleBits = 64
+	MantBits         = EntropyScaleBits
 )
 
 // Common big integers often used
@@ -42,88 +54,895 @@ var (
 	Big101   = big.NewInt(101)
 	Big256   = big.NewInt(256)
 	Big257   = big.NewInt(257)
-	Big2e64  = new(big.Int).Exp(big.NewInt(2), big.NewInt(64), big.NewInt(0))
+	Big2e64  = new(big.Int).Lsh(big.NewInt(1), EntropyScaleBits)
 	Big2e256 = new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
 )
 
+// MantDivisor is the precomputed 2^MantBits scale of the mantissa returned by
+// mathutil.BinaryLog, which LogBig and BitsToBigBits combine with the
+// characteristic. It must never be mutated; use MantDivisorCopy for a value
+// that is safe to modify.
+var MantDivisor = new(big.Int).Exp(big.NewInt(2), big.NewInt(MantBits), nil)
+
+// MantDivisorCopy returns a copy of MantDivisor that is safe for the caller to
+// mutate.
+func MantDivisorCopy() *big.Int {
+	return new(big.Int).Set(MantDivisor)
+}
+
+// The entropy conversion functions always return freshly allocated values,
+// which the caller owns and may mutate without affecting later results or the
+// common values above. Any pooling of intermediates must keep this guarantee.
+
+// ErrDivideByZero is returned by the entropy math when a divisor is zero, which
+// can only happen if one of the common values has been corrupted.
+var ErrDivideByZero = errors.New("division by zero in entropy conversion")
+
+// ErrEntropyOverflow is returned when an accumulated entropy exceeds the
+// maximum considered plausible by the caller.
+var ErrEntropyOverflow = errors.New("accumulated entropy exceeds maximum")
+
+// checkDivisor returns ErrDivideByZero if y is nil or zero.
+func checkDivisor(y *big.Int) error {
+	if y == nil || y.Sign() == 0 {
+		return ErrDivideByZero
+	}
+	return nil
+}
+
+// safeDiv returns the Euclidean quotient x/y, or ErrDivideByZero instead of
+// panicking if y is zero.
+func safeDiv(x, y *big.Int) (*big.Int, error) {
+	if err := checkDivisor(y); err != nil {
+		return nil, err
+	}
+	return new(big.Int).Div(x, y), nil
+}
+
+// RoundingPolicy selects how a big-bits entropy is rounded to whole bits.
+type RoundingPolicy int
+
+const (
+	// RoundTruncate rounds towards negative infinity.
+	RoundTruncate RoundingPolicy = iota
+	// RoundHalfUp rounds to the nearest bit, with ties rounded up.
+	RoundHalfUp
+	// RoundHalfEven rounds to the nearest bit, with ties going to the even bit.
+	RoundHalfEven
+)
+
+// BigBitsToBits converts a 2^64 scaled big-bits entropy into whole bits. If the
+// scaling constant has been corrupted to zero, the error is logged and zero is
+// returned instead of panicking.
 func BigBitsToBits(original *big.Int) *big.Int {
-	return big.NewInt(0).Div(original, Big2e64)
+	return BigBitsToBitsWith(original, RoundTruncate)
+}
+
+// BigBitsToBitsWith converts a 2^64 scaled big-bits entropy into whole bits,
+// rounding according to the given policy. If the scaling constant has been
+// corrupted to zero, the error is logged and zero is returned.
+func BigBitsToBitsWith(original *big.Int, policy RoundingPolicy) *big.Int {
+	bits, err := safeDiv(original, Big2e64)
+	if err != nil {
+		log.Global.WithField("err", err).Error("Failed to convert big bits to bits")
+		return big.NewInt(0)
+	}
+	if policy == RoundTruncate {
+		return bits
+	}
+	rem := new(big.Int).Sub(original, new(big.Int).Mul(bits, Big2e64))
+	switch rem.Lsh(rem, 1).Cmp(Big2e64) {
+	case 1:
+		bits.Add(bits, Big1)
+	case 0:
+		if policy == RoundHalfUp || bits.Bit(0) == 1 {
+			bits.Add(bits, Big1)
+		}
+	}
+	return bits
+}
+
+// BigBitsToBitsRoundEven converts a 2^64 scaled big-bits entropy into whole
+// bits, rounding to the nearest bit with ties going to the even bit. Unlike the
+// truncation of BigBitsToBits, this does not bias aggregated statistics.
+func BigBitsToBitsRoundEven(original *big.Int) *big.Int {
+	return BigBitsToBitsWith(original, RoundHalfEven)
 }
 
 func BigBitsToBitsFloat(original *big.Int) *big.Float {
 	return new(big.Float).Quo(new(big.Float).SetInt(original), new(big.Float).SetInt(Big2e64))
 }
 
+// BigBitsToRat returns the exact rational value original / 2^64 of a big-bits
+// entropy, with none of the precision loss of BigBitsToBitsFloat. If the
+// scaling constant has been corrupted to zero, the error is logged and zero is
+// returned instead of panicking.
+func BigBitsToRat(original *big.Int) *big.Rat {
+	if err := checkDivisor(Big2e64); err != nil {
+		log.Global.WithField("err", err).Error("Failed to convert big bits to a rational")
+		return new(big.Rat)
+	}
+	return new(big.Rat).SetFrac(original, Big2e64)
+}
+
+// EntropyString formats a big-bits entropy in whole bits with a fixed number of
+// decimals. The value is rounded exactly using rational arithmetic, to the
+// nearest with halves away from zero, so the output is deterministic.
+func EntropyString(bigBits *big.Int, decimals int) string {
+	if decimals < 0 {
+		decimals = 0
+	}
+	return BigBitsToRat(bigBits).FloatString(decimals)
+}
+
 func BitsToBigBits(original *big.Int) *big.Int {
-	c, m := mathutil.BinaryLog(original, 64)
-	bigBits := new(big.Int).Mul(big.NewInt(int64(c)), new(big.Int).Exp(big.NewInt(2), big.NewInt(64), nil))
+	c, m := mathutil.BinaryLog(original, MantBits)
+	bigBits := new(big.Int).Mul(big.NewInt(int64(c)), MantDivisor)
 	bigBits = new(big.Int).Add(bigBits, m)
 	return bigBits
 }
 
+// EntropyRoundTripError returns the residual lost when converting a big-bits
+// entropy to whole bits with BigBitsToBits and scaling it back by 2^64, i.e.
+// the fractional bits discarded by the truncation. A nonzero residual below
+// 2^64 is expected and normal. Note that BitsToBigBits is not the inverse of
+// BigBitsToBits, as it takes the binary logarithm of its input, so the scaling
+// is undone directly.
+func EntropyRoundTripError(original *big.Int) *big.Int {
+	restored := new(big.Int).Mul(BigBitsToBits(original), Big2e64)
+	return restored.Sub(original, restored)
+}
+
 func BigBitsArrayToBitsArray(original []*big.Int) []*big.Int {
 	bitsArray := make([]*big.Int, len(original))
 	for i, bits := range original {
-		bitsArray[i] = big.NewInt(0).Div(bits, Big2e64)
+		bitsArray[i] = BigBitsToBits(bits)
 	}
 
 	return bitsArray
 }
 
 func EntropyBigBitsToDifficultyBits(bigBits *big.Int) *big.Int {
-	twopowerBits := new(big.Int).Exp(big.NewInt(2), new(big.Int).Div(bigBits, Big2e64), nil)
-	return new(big.Int).Div(Big2e256, twopowerBits)
+	twopowerBits := new(big.Int).Exp(big.NewInt(2), BigBitsToBits(bigBits), nil)
+	difficulty, err := safeDiv(Big2e256, twopowerBits)
+	if err != nil {
+		log.Global.WithField("err", err).Error("Failed to convert entropy to difficulty")
+		return big.NewInt(0)
+	}
+	return difficulty
+}
+
+// EntropyToExpectedHashes returns the expected number of hashes needed to
+// produce a big-bits entropy, 2^(entropyBits / 2^64), which is the difficulty
+// whose LogBig is entropyBits. EntropyBigBitsToDifficultyBits instead returns
+// the corresponding whole bit target, 2^256 divided by this figure. Results
+// are clamped to [1, 2^256 - 1], the range of valid difficulties; the upper
+// clamp is applied by the inverse conversion itself, which also covers
+// entropies just below 256 bits whose float evaluation would round up to 2^256.
+func EntropyToExpectedHashes(entropyBits *big.Int) *big.Int {
+	if entropyBits.Sign() <= 0 {
+		return big.NewInt(1)
+	}
+	return inverseLogBig(entropyBits)
+}
+
+// IsValidDifficulty reports whether a difficulty lies within the range that can
+// be represented in the entropy domain, i.e. 0 < diff < 2^256.
+func IsValidDifficulty(diff *big.Int) bool {
+	return diff != nil && diff.Sign() > 0 && diff.Cmp(Big2e256) < 0
 }
 
 // IntrinsicLogEntropy returns the logarithm of the intrinsic entropy reduction of a PoW hash
 func LogBig(diff *big.Int) *big.Int {
 	diffCopy := new(big.Int).Set(diff)
 	c, m := mathutil.BinaryLog(diffCopy, MantBits)
-	bigBits := new(big.Int).Mul(big.NewInt(int64(c)), new(big.Int).Exp(big.NewInt(2), big.NewInt(MantBits), nil))
+	bigBits := new(big.Int).Mul(big.NewInt(int64(c)), MantDivisor)
 	bigBits = new(big.Int).Add(bigBits, m)
 	return bigBits
 }
 
+// LogBigExact returns the entropy of diff like LogBig, but computes exact
+// powers of two directly as k*2^MantBits without going through the binary log
+// approximation, whose last mantissa bit may be off for such inputs. The bool
+// reports whether the returned value is exact; all other inputs are delegated
+// to LogBig.
+func LogBigExact(diff *big.Int) (*big.Int, bool) {
+	if diff.Sign() > 0 && diff.TrailingZeroBits() == uint(diff.BitLen()-1) {
+		return new(big.Int).Lsh(big.NewInt(int64(diff.BitLen()-1)), MantBits), true
+	}
+	return LogBig(diff), false
+}
+
+// LogBigToUnits returns LogBig(diff) in whole entropy units, i.e. divided by
+// 2^MantBits, as a float suitable for metrics. The float64 conversion keeps
+// 53 bits of precision, so the least significant fractional bits of the
+// entropy are lost; it must not be used where exact entropy is required.
+func LogBigToUnits(diff *big.Int) float64 {
+	units, _ := BigBitsToBitsFloat(LogBig(diff)).Float64()
+	return units
+}
+
+// NormalizedDifficultyScore maps a difficulty to a [0, 1] gauge value relative
+// to a reference maximum, as the entropy ratio LogBig(diff) / LogBig(referenceMax).
+// A difficulty at or above the reference scores 1, and zero is returned if
+// either difficulty fails IsValidDifficulty.
+func NormalizedDifficultyScore(diff, referenceMax *big.Int) float64 {
+	if !IsValidDifficulty(diff) || !IsValidDifficulty(referenceMax) {
+		return 0
+	}
+	if referenceMax.Cmp(diff) <= 0 {
+		return 1
+	}
+	score, _ := new(big.Rat).SetFrac(LogBig(diff), LogBig(referenceMax)).Float64()
+	return math.Max(0, math.Min(1, score))
+}
+
+// ReduceDifficultyRatio reduces the ratio a:b to its lowest terms by dividing
+// both sides by their greatest common divisor. A zero denominator yields (a, 1)
+// and a zero numerator yields (0, 1). The inputs are not modified.
+func ReduceDifficultyRatio(a, b *big.Int) (*big.Int, *big.Int) {
+	if b.Sign() == 0 {
+		return new(big.Int).Set(a), big.NewInt(1)
+	}
+	if a.Sign() == 0 {
+		return big.NewInt(0), big.NewInt(1)
+	}
+	gcd := new(big.Int).GCD(nil, nil, a, b)
+	num, den := new(big.Int).Quo(a, gcd), new(big.Int).Quo(b, gcd)
+	if den.Sign() < 0 {
+		num.Neg(num)
+		den.Neg(den)
+	}
+	return num, den
+}
+
+// difficultySuffixes are the SI prefixes used by FormatDifficulty, one per
+// factor of 1000.
+var difficultySuffixes = []string{"", "K", "M", "G", "T", "P", "E", "Z", "Y"}
+
+// FormatDifficulty renders a difficulty with an SI-like suffix, e.g.
+// "1.23 Pdiff", picking the magnitude bucket from the LogBig entropy of the
+// difficulty. Nil and non-positive difficulties are rendered verbatim.
+func FormatDifficulty(diff *big.Int) string {
+	if diff == nil {
+		return "<nil>"
+	}
+	if diff.Sign() <= 0 {
+		return diff.String() + " diff"
+	}
+	// log10(diff) = log2(diff) * log10(2), each bucket spans three decimal digits
+	bucket := int(LogBigToUnits(diff) * math.Log10(2) / 3)
+	if bucket >= len(difficultySuffixes) {
+		bucket = len(difficultySuffixes) - 1
+	}
+	scaled := func(bucket int) *big.Float {
+		divisor := new(big.Int).Exp(big.NewInt(1000), big.NewInt(int64(bucket)), nil)
+		return new(big.Float).Quo(new(big.Float).SetInt(diff), new(big.Float).SetInt(divisor))
+	}
+	value := scaled(bucket)
+	// Correct float rounding of the bucket right at the powers of 1000
+	thousand := big.NewFloat(1000)
+	for bucket < len(difficultySuffixes)-1 && value.Cmp(thousand) >= 0 {
+		bucket++
+		value = scaled(bucket)
+	}
+	for bucket > 0 && value.Cmp(big.NewFloat(1)) < 0 {
+		bucket--
+		value = scaled(bucket)
+	}
+	if bucket == 0 {
+		return diff.String() + " diff"
+	}
+	return fmt.Sprintf("%s %sdiff", value.Text('f', 2), difficultySuffixes[bucket])
+}
+
+// EntropyDelta returns the magnitude of the entropy change between two
+// difficulties, |LogBig(newDiff) - LogBig(oldDiff)|, in big-bits.
+func EntropyDelta(oldDiff, newDiff *big.Int) *big.Int {
+	delta, _ := SignedEntropyDelta(oldDiff, newDiff)
+	return delta
+}
+
+// SignedEntropyDelta returns the magnitude of the entropy change between two
+// difficulties along with its direction: +1 if newDiff carries more entropy
+// than oldDiff, -1 if it carries less and 0 if both are equal.
+func SignedEntropyDelta(oldDiff, newDiff *big.Int) (*big.Int, int) {
+	delta := new(big.Int).Sub(LogBig(newDiff), LogBig(oldDiff))
+	sign := delta.Sign()
+	return delta.Abs(delta), sign
+}
+
+// EntropyPercentChange returns the percentage change in entropy from oldDiff
+// to newDiff, 100 * (LogBig(newDiff) - LogBig(oldDiff)) / LogBig(oldDiff).
+// This is a change in log-difficulty and is much smaller than the naive ratio
+// of the raw difficulties: doubling a difficulty of 2^32 is a 3.125% entropy
+// increase, not 100%. An error is returned if either difficulty is invalid or
+// oldDiff carries no entropy.
+func EntropyPercentChange(oldDiff, newDiff *big.Int) (float64, error) {
+	if !IsValidDifficulty(oldDiff) || !IsValidDifficulty(newDiff) {
+		return 0, fmt.Errorf("invalid difficulty: old %v, new %v", oldDiff, newDiff)
+	}
+	oldEntropy := LogBig(oldDiff)
+	if oldEntropy.Sign() == 0 {
+		return 0, ErrDivideByZero
+	}
+	change := new(big.Rat).SetFrac(new(big.Int).Sub(LogBig(newDiff), oldEntropy), oldEntropy)
+	percent, _ := change.Mul(change, big.NewRat(100, 1)).Float64()
+	return percent, nil
+}
+
+// EntropyDeltaInDoublings returns the entropy change from oldDiff to newDiff
+// in whole bits, which is the number of times the difficulty doubled. The
+// count is negative if the difficulty fell and fractional for changes that are
+// not powers of two. An error is returned if either difficulty is invalid.
+func EntropyDeltaInDoublings(oldDiff, newDiff *big.Int) (float64, error) {
+	if !IsValidDifficulty(oldDiff) || !IsValidDifficulty(newDiff) {
+		return 0, fmt.Errorf("invalid difficulty: old %v, new %v", oldDiff, newDiff)
+	}
+	doublings, _ := BigBitsToBitsFloat(new(big.Int).Sub(LogBig(newDiff), LogBig(oldDiff))).Float64()
+	return doublings, nil
+}
+
+// ClampEntropyDelta suppresses sub-threshold noise in an entropy delta for
+// display purposes, returning zero if the absolute delta is below floor and a
+// copy of the delta otherwise. It must not be used in consensus code.
+func ClampEntropyDelta(delta *big.Int, floor *big.Int) *big.Int {
+	if new(big.Int).Abs(delta).Cmp(floor) < 0 {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(delta)
+}
+
+// inverseLogBig returns the difficulty 2^(bigBits / 2^64) whose LogBig is
+// bigBits. The fractional power of two is evaluated in float64, so the result
+// carries a relative error of about 2^-52 on top of the truncation of the
+// mantissa done by LogBig. Entropies below zero yield a difficulty of zero, and
+// results are clamped to Big2e256 - 1, the largest valid difficulty. If the
+// scaling constant has been corrupted to zero, the error is logged and zero is
+// returned instead of panicking.
+func inverseLogBig(bigBits *big.Int) *big.Int {
+	if err := checkDivisor(Big2e64); err != nil {
+		log.Global.WithField("err", err).Error("Failed to convert big bits to a difficulty")
+		return big.NewInt(0)
+	}
+	c, m := new(big.Int).DivMod(bigBits, Big2e64, new(big.Int))
+	if c.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	if c.Cmp(Big256) >= 0 {
+		return new(big.Int).Sub(Big2e256, Big1)
+	}
+	// m < 2^64, but the float64 conversion may round it up to 2^64 itself, and
+	// the power of two may round up to 2 near the top; keep both below their
+	// bounds so the result never spills over into 2^(c+1)
+	frac, _ := new(big.Float).SetInt(m).Float64()
+	frac = math.Min(math.Ldexp(frac, -EntropyScaleBits), math.Nextafter(1, 0))
+	f := new(big.Float).SetFloat64(math.Min(math.Exp2(frac), math.Nextafter(2, 0)))
+	result, _ := f.SetMantExp(f, int(c.Int64())).Int(nil)
+	return result
+}
+
+// CumulativeEntropyToTotalDifficulty converts an accumulated big-bits entropy
+// into the equivalent Ethereum style total difficulty, for external tools which
+// expect one. As the entropy lives in the logarithmic domain the conversion is
+// approximate, with a relative error of about 2^-50. Results are clamped to
+// Big2e256 - 1.
+func CumulativeEntropyToTotalDifficulty(entropyBigBits *big.Int) *big.Int {
+	return inverseLogBig(entropyBigBits)
+}
+
+// SimulateDifficultySeries models the evolution of a difficulty under a given
+// entropy trajectory. Starting from startDifficulty, each big-bits delta is
+// applied in the entropy domain and the resulting difficulty is recorded, so the
+// returned series has one entry per delta. Deltas may be negative; the modelled
+// entropy is floored at zero, i.e. a difficulty of one, and difficulties above
+// the valid range are reported as Big2e256 - 1 while the entropy keeps
+// accumulating. The inputs are not modified, and nil is returned for a
+// non-positive start difficulty.
+func SimulateDifficultySeries(startDifficulty *big.Int, entropyDeltas []*big.Int) []*big.Int {
+	if startDifficulty == nil || startDifficulty.Sign() <= 0 {
+		return nil
+	}
+	entropy := LogBig(startDifficulty)
+	series := make([]*big.Int, len(entropyDeltas))
+	for i, delta := range entropyDeltas {
+		entropy.Add(entropy, delta)
+		if entropy.Sign() < 0 {
+			entropy.SetInt64(0)
+		}
+		series[i] = inverseLogBig(entropy)
+	}
+	return series
+}
+
+// MaxPreviewEntropyStep is the largest entropy change, in whole entropy units,
+// that PreviewDifficultyForBlockTime applies for a single block. A step of 1/8
+// bounds the projected difficulty change to about 9% per block.
+const MaxPreviewEntropyStep = 1.0 / 8
+
+// PreviewDifficultyForBlockTime projects the next difficulty from an observed
+// block time, for mining tooling. The entropy of currentDiff is moved by
+// log2(targetTime / actualTime), clamped to +/-MaxPreviewEntropyStep, so the
+// difficulty rises when blocks come too fast and falls when they are too slow.
+// This is not the consensus adjustment. Nil is returned for an invalid current
+// difficulty or a non-positive target time.
+func PreviewDifficultyForBlockTime(currentDiff *big.Int, actualTime, targetTime time.Duration) *big.Int {
+	if !IsValidDifficulty(currentDiff) || targetTime <= 0 {
+		return nil
+	}
+	step := MaxPreviewEntropyStep
+	if actualTime > 0 {
+		step = math.Max(-MaxPreviewEntropyStep, math.Min(MaxPreviewEntropyStep, math.Log2(float64(targetTime)/float64(actualTime))))
+	}
+	if step == 0 {
+		return new(big.Int).Set(currentDiff)
+	}
+	stepBigBits, _ := new(big.Float).SetFloat64(math.Ldexp(step, EntropyScaleBits)).Int(nil)
+	entropy := new(big.Int).Add(LogBig(currentDiff), stepBigBits)
+	if entropy.Sign() < 0 {
+		entropy.SetInt64(0)
+	}
+	return inverseLogBig(entropy)
+}
+
+// UncleEntropyContribution returns the entropy contributed by an uncle of the
+// given difficulty, LogBig(uncleDiff) scaled by the discount fraction
+// discountNumerator / discountDenominator. A zero denominator is logged and
+// yields zero, as does an uncle difficulty failing IsValidDifficulty.
+func UncleEntropyContribution(uncleDiff *big.Int, discountNumerator, discountDenominator *big.Int) *big.Int {
+	if !IsValidDifficulty(uncleDiff) {
+		return big.NewInt(0)
+	}
+	contribution := new(big.Int).Mul(LogBig(uncleDiff), discountNumerator)
+	contribution, err := safeDiv(contribution, discountDenominator)
+	if err != nil {
+		log.Global.WithField("err", err).Warn("Invalid uncle entropy discount")
+		return big.NewInt(0)
+	}
+	return contribution
+}
+
+// CheckEntropyMonotonic verifies that the cumulative entropy of a chain segment
+// never decreases, accumulating the LogBig of each block's difficulty into a
+// running total. A nil or non-positive difficulty has no entropy and is flagged
+// as a regression. It returns the index of the first block at which the
+// cumulative entropy would decrease along with true, or -1 and false if the
+// segment is monotonic.
+func CheckEntropyMonotonic(difficulties []*big.Int) (int, bool) {
+	total := new(big.Int)
+	for i, diff := range difficulties {
+		if diff == nil || diff.Sign() <= 0 {
+			return i, true
+		}
+		next := new(big.Int).Add(total, LogBig(diff))
+		if next.Cmp(total) < 0 {
+			return i, true
+		}
+		total = next
+	}
+	return -1, false
+}
+
+// HarmonicMeanIntervals returns the harmonic mean of the intervals between
+// consecutive block timestamps, in the unit of the timestamps. Being dominated
+// by the shortest intervals, it is more sensitive to fast blocks than the
+// arithmetic mean, making it a useful input to PreviewDifficultyForBlockTime.
+// The timestamps must be strictly increasing and at least two are required.
+func HarmonicMeanIntervals(timestamps []uint64) (float64, error) {
+	if len(timestamps) < 2 {
+		return 0, fmt.Errorf("need at least two timestamps, have %d", len(timestamps))
+	}
+	var reciprocals float64
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			return 0, fmt.Errorf("timestamp %d at index %d does not follow %d", timestamps[i], i, timestamps[i-1])
+		}
+		reciprocals += 1 / float64(timestamps[i]-timestamps[i-1])
+	}
+	return float64(len(timestamps)-1) / reciprocals, nil
+}
+
+// DifficultyForHalvedBlockTime returns the difficulty whose entropy is exactly
+// one bit above that of currentDiff, i.e. twice the difficulty, computed
+// through the entropy domain. At a constant hash rate this halves the expected
+// block time. As the conversion back from entropy is approximate, the result is
+// only exactly twice currentDiff for powers of two. Doubling a difficulty of
+// 2^255 or more would leave the valid range, so the result is clamped to
+// Big2e256 - 1. Nil is returned if currentDiff fails IsValidDifficulty.
+func DifficultyForHalvedBlockTime(currentDiff *big.Int) *big.Int {
+	if !IsValidDifficulty(currentDiff) {
+		return nil
+	}
+	return inverseLogBig(new(big.Int).Add(LogBig(currentDiff), Big2e64))
+}
+
+// EntropyBudgetConsumed returns the fraction of an entropy budget, in
+// big-bits, consumed by the summed LogBig entropies of a difficulty series,
+// along with whether the budget was exceeded. Consuming exactly the budget does
+// not exceed it. A budget that is not positive can not be met and is reported
+// as exceeded with a fraction of zero. Entries failing IsValidDifficulty are
+// skipped.
+func EntropyBudgetConsumed(difficulties []*big.Int, budget *big.Int) (float64, bool) {
+	if budget == nil || budget.Sign() <= 0 {
+		return 0, true
+	}
+	consumed := new(big.Int)
+	for _, diff := range difficulties {
+		if IsValidDifficulty(diff) {
+			consumed.Add(consumed, LogBig(diff))
+		}
+	}
+	fraction, _ := new(big.Rat).SetFrac(consumed, budget).Float64()
+	return fraction, consumed.Cmp(budget) > 0
+}
+
+// AddEntropyChecked returns total + delta, or ErrEntropyOverflow if the sum
+// exceeds max. This allows a running entropy total to detect a single corrupt
+// difficulty producing an absurd contribution before it poisons the total. The
+// inputs are not modified.
+func AddEntropyChecked(total, delta *big.Int, max *big.Int) (*big.Int, error) {
+	sum := new(big.Int).Add(total, delta)
+	if sum.Cmp(max) > 0 {
+		return nil, fmt.Errorf("%w: %v > %v", ErrEntropyOverflow, sum, max)
+	}
+	return sum, nil
+}
+
+// EntropyTotalPlausible reports whether a cumulative entropy total lies within
+// [blockCount*minPerBlock, blockCount*maxPerBlock], as a cheap bounds check on
+// advertised chain weights before any expensive verification. A nil total or
+// bound is never plausible.
+func EntropyTotalPlausible(total *big.Int, blockCount uint64, minPerBlock, maxPerBlock *big.Int) bool {
+	if total == nil || minPerBlock == nil || maxPerBlock == nil {
+		return false
+	}
+	count := new(big.Int).SetUint64(blockCount)
+	if total.Cmp(new(big.Int).Mul(count, minPerBlock)) < 0 {
+		return false
+	}
+	return total.Cmp(new(big.Int).Mul(count, maxPerBlock)) <= 0
+}
+
+// AddDifficultySaturating returns a + b clamped to Big2e256 - 1, for bounded
+// difficulty accumulators in tools that assume totals fit in 256 bits. The bool
+// reports whether the sum was clamped. The inputs are not modified.
+func AddDifficultySaturating(a, b *big.Int) (*big.Int, bool) {
+	sum := new(big.Int).Add(a, b)
+	if sum.Cmp(Big2e256) >= 0 {
+		return sum.Sub(Big2e256, Big1), true
+	}
+	return sum, false
+}
+
+// maxScientificDigits bounds the number of integer digits ParseBigScientific
+// accepts, so that absurd exponents are rejected before allocating.
+const maxScientificDigits = 1000
+
+// ParseBigScientific parses a decimal integer that may be written in scientific
+// notation, e.g. "1.5e40". The mantissa digits are shifted by the exponent
+// exactly, without going through a float, and an error is returned if the value
+// has a fractional remainder or more than maxScientificDigits integer digits.
+// Leading zeros of the mantissa do not count towards the digit limit, so
+// "0.001e3" is accepted as 1.
+func ParseBigScientific(s string) (*big.Int, error) {
+	s = strings.TrimSpace(s)
+	mantissa, exponent := s, int64(0)
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.ParseInt(s[i+1:], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent in %q: %w", s, err)
+		}
+		mantissa, exponent = s[:i], exp
+	}
+	negative := false
+	if len(mantissa) > 0 && (mantissa[0] == '+' || mantissa[0] == '-') {
+		negative, mantissa = mantissa[0] == '-', mantissa[1:]
+	}
+	intPart, fracPart, _ := strings.Cut(mantissa, ".")
+	digits := intPart + fracPart
+	if digits == "" || strings.IndexFunc(digits, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	// The value is digits * 10^exponent once the fractional digits are folded
+	// into the exponent. Leading zeros carry no value and trailing zeros only
+	// raise the exponent, so neither counts as a significant digit.
+	exponent -= int64(len(fracPart))
+	digits = strings.TrimLeft(digits, "0")
+	significant := strings.TrimRight(digits, "0")
+	exponent += int64(len(digits) - len(significant))
+	if significant == "" {
+		return new(big.Int), nil
+	}
+	if exponent < 0 {
+		return nil, fmt.Errorf("value %q has a fractional part", s)
+	}
+	if int64(len(significant))+exponent > maxScientificDigits {
+		return nil, fmt.Errorf("value %q exceeds %d digits", s, maxScientificDigits)
+	}
+	result, _ := new(big.Int).SetString(significant, 10)
+	result.Mul(result, new(big.Int).Exp(big.NewInt(10), big.NewInt(exponent), nil))
+	if negative {
+		result.Neg(result)
+	}
+	return result, nil
+}
+
+// GeometricMeanDifficulty returns the geometric mean of a difficulty series,
+// computed as the arithmetic mean of the LogBig entropies converted back into a
+// difficulty. Entries failing IsValidDifficulty are skipped, and nil is returned
+// if no valid entries remain. The result is always a valid difficulty, even for
+// entries at the top of the range.
+func GeometricMeanDifficulty(difficulties []*big.Int) *big.Int {
+	sum, count := new(big.Int), int64(0)
+	for _, diff := range difficulties {
+		if !IsValidDifficulty(diff) {
+			continue
+		}
+		sum.Add(sum, LogBig(diff))
+		count++
+	}
+	if count == 0 {
+		return nil
+	}
+	return inverseLogBig(sum.Quo(sum, big.NewInt(count)))
+}
+
+// EncodeDifficultyCompact serializes a difficulty in its canonical compact
+// form: a single length byte followed by the minimal big-endian encoding of the
+// value, so zero encodes as 0x00. Nil is returned for nil or negative values
+// and for values whose magnitude does not fit in 255 bytes.
+func EncodeDifficultyCompact(diff *big.Int) []byte {
+	if diff == nil || diff.Sign() < 0 {
+		return nil
+	}
+	magnitude := diff.Bytes()
+	if len(magnitude) > math.MaxUint8 {
+		return nil
+	}
+	return append([]byte{byte(len(magnitude))}, magnitude...)
+}
+
+// EntropyPerEncodedByte returns the entropy of diff, in bits, per byte of its
+// EncodeDifficultyCompact encoding, as a storage efficiency metric. Zero is
+// returned for difficulties failing IsValidDifficulty, including zero, which
+// carry no entropy.
+func EntropyPerEncodedByte(diff *big.Int) float64 {
+	if !IsValidDifficulty(diff) {
+		return 0
+	}
+	encoded := EncodeDifficultyCompact(diff)
+	if len(encoded) == 0 {
+		return 0
+	}
+	return LogBigToUnits(diff) / float64(len(encoded))
+}
+
+// DecodeDifficultyCompact parses a difficulty encoded by EncodeDifficultyCompact.
+// Nil is returned if the length byte does not match the data or the encoding is
+// not minimal, so that every difficulty has exactly one accepted encoding.
+func DecodeDifficultyCompact(b []byte) *big.Int {
+	if len(b) == 0 || int(b[0]) != len(b)-1 {
+		return nil
+	}
+	if len(b) > 1 && b[1] == 0 {
+		return nil
+	}
+	return new(big.Int).SetBytes(b[1:])
+}
+
+// InterpolateDifficulty interpolates between the difficulties a and b in the
+// entropy domain, so that t = 0.5 yields their geometric rather than arithmetic
+// mean. The position t is clamped to [0, 1], and the endpoints are returned
+// exactly. Nil is returned if either difficulty fails IsValidDifficulty.
+func InterpolateDifficulty(a, b *big.Int, t float64) *big.Int {
+	if !IsValidDifficulty(a) || !IsValidDifficulty(b) {
+		return nil
+	}
+	switch {
+	case t <= 0 || math.IsNaN(t):
+		return new(big.Int).Set(a)
+	case t >= 1:
+		return new(big.Int).Set(b)
+	}
+	entropyA := LogBig(a)
+	span := new(big.Float).SetInt(new(big.Int).Sub(LogBig(b), entropyA))
+	offset, _ := span.Mul(span, big.NewFloat(t)).Int(nil)
+	return inverseLogBig(offset.Add(offset, entropyA))
+}
+
+// ClampDifficultyBand clamps diff into the band of difficulties whose entropy
+// lies within LogBig(center) +/- halfWidthBits, with the half width given in
+// big-bits. A difficulty inside the band is returned unchanged, one outside it
+// is replaced by the difficulty at the nearest band edge. Nil is returned if
+// diff or center fails IsValidDifficulty or the half width is negative.
+func ClampDifficultyBand(diff, center, halfWidthBits *big.Int) *big.Int {
+	if !IsValidDifficulty(diff) || !IsValidDifficulty(center) || halfWidthBits == nil || halfWidthBits.Sign() < 0 {
+		return nil
+	}
+	entropy, centerEntropy := LogBig(diff), LogBig(center)
+	if upper := new(big.Int).Add(centerEntropy, halfWidthBits); entropy.Cmp(upper) > 0 {
+		return inverseLogBig(upper)
+	}
+	if lower := new(big.Int).Sub(centerEntropy, halfWidthBits); entropy.Cmp(lower) < 0 {
+		return inverseLogBig(lower)
+	}
+	return new(big.Int).Set(diff)
+}
+
+// maxChainWeightLength is the largest magnitude, in bytes, of a chain weight
+// accepted by EncodeChainWeight and DecodeChainWeight.
+const maxChainWeightLength = 32
+
+// ErrInvalidChainWeight is returned when decoding a malformed or oversized
+// chain weight.
+var ErrInvalidChainWeight = errors.New("invalid chain weight encoding")
+
+// EncodeChainWeight serializes a big-bits entropy chain weight for the wire in
+// the canonical compact form of EncodeDifficultyCompact. Nil is returned for
+// nil or negative weights and for weights of 2^256 or more.
+func EncodeChainWeight(weight *big.Int) []byte {
+	if weight == nil || weight.Sign() < 0 || len(weight.Bytes()) > maxChainWeightLength {
+		return nil
+	}
+	return EncodeDifficultyCompact(weight)
+}
+
+// DecodeChainWeight parses a chain weight encoded by EncodeChainWeight,
+// rejecting non canonical encodings and weights of 2^256 or more.
+func DecodeChainWeight(b []byte) (*big.Int, error) {
+	if len(b) > maxChainWeightLength+1 {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidChainWeight, len(b))
+	}
+	weight := DecodeDifficultyCompact(b)
+	if weight == nil {
+		return nil, fmt.Errorf("%w: %x", ErrInvalidChainWeight, b)
+	}
+	return weight, nil
+}
+
+// WeightedAverageDifficulty returns the weighted mean of the LogBig entropies
+// of a difficulty series converted back into a difficulty, generalising
+// GeometricMeanDifficulty with per entry weights. An error is returned if the
+// slice lengths differ, a difficulty fails IsValidDifficulty, a weight is
+// negative or the weights sum to zero.
+func WeightedAverageDifficulty(difficulties, weights []*big.Int) (*big.Int, error) {
+	if len(difficulties) != len(weights) {
+		return nil, fmt.Errorf("have %d difficulties but %d weights", len(difficulties), len(weights))
+	}
+	sum, totalWeight := new(big.Int), new(big.Int)
+	for i, diff := range difficulties {
+		if !IsValidDifficulty(diff) {
+			return nil, fmt.Errorf("invalid difficulty %v at index %d", diff, i)
+		}
+		if weights[i] == nil || weights[i].Sign() < 0 {
+			return nil, fmt.Errorf("invalid weight %v at index %d", weights[i], i)
+		}
+		sum.Add(sum, new(big.Int).Mul(LogBig(diff), weights[i]))
+		totalWeight.Add(totalWeight, weights[i])
+	}
+	if totalWeight.Sign() == 0 {
+		return nil, ErrDivideByZero
+	}
+	return inverseLogBig(sum.Quo(sum, totalWeight)), nil
+}
+
 // Continously verify that the common values have not been overwritten.
 func SanityCheck(quitCh chan struct{}) {
-	big0 := big.NewInt(0)
-	big1 := big.NewInt(1)
-	big2 := big.NewInt(2)
-	big3 := big.NewInt(3)
-	big8 := big.NewInt(8)
-	big10 := big.NewInt(10)
-	big32 := big.NewInt(32)
-	big99 := big.NewInt(99)
-	big100 := big.NewInt(100)
-	big101 := big.NewInt(101)
-	big256 := big.NewInt(256)
-	big257 := big.NewInt(257)
-	big2e64 := new(big.Int).Exp(big.NewInt(2), big.NewInt(64), big.NewInt(0))
-	big2e256 := new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0))
-
-	go func(quitCh chan struct{}) {
+	SanityCheckWithHandler(1*time.Minute, func(name string) {
+		// Send a message to quitCh to abort.
+		log.Global.WithField("name", name).Error("A common value has mutated, exiting now")
+		quitCh <- struct{}{}
+	})
+}
+
+// SanityCheckWithHandler continously verifies that the common values have not
+// been overwritten, checking once every interval. When a mutated value is
+// detected, onCorrupt is invoked with the name of the offending variable. A
+// non-positive interval defaults to one minute. The returned function stops the
+// checker and waits for it to exit, including any onCorrupt call in flight; it
+// is safe to call more than once.
+func SanityCheckWithHandler(interval time.Duration, onCorrupt func(name string)) (stop func()) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	expected := []struct {
+		name  string
+		value *big.Int
+		got   func() *big.Int
+	}{
+		{"Big0", big.NewInt(0), func() *big.Int { return Big0 }},
+		{"Big1", big.NewInt(1), func() *big.Int { return Big1 }},
+		{"Big2", big.NewInt(2), func() *big.Int { return Big2 }},
+		{"Big3", big.NewInt(3), func() *big.Int { return Big3 }},
+		{"Big8", big.NewInt(8), func() *big.Int { return Big8 }},
+		{"Big10", big.NewInt(10), func() *big.Int { return Big10 }},
+		{"Big32", big.NewInt(32), func() *big.Int { return Big32 }},
+		{"Big99", big.NewInt(99), func() *big.Int { return Big99 }},
+		{"Big100", big.NewInt(100), func() *big.Int { return Big100 }},
+		{"Big101", big.NewInt(101), func() *big.Int { return Big101 }},
+		{"Big256", big.NewInt(256), func() *big.Int { return Big256 }},
+		{"Big257", big.NewInt(257), func() *big.Int { return Big257 }},
+		{"Big2e64", new(big.Int).Lsh(big.NewInt(1), EntropyScaleBits), func() *big.Int { return Big2e64 }},
+		{"Big2e256", new(big.Int).Exp(big.NewInt(2), big.NewInt(256), big.NewInt(0)), func() *big.Int { return Big2e256 }},
+		{"MantDivisor", new(big.Int).Exp(big.NewInt(2), big.NewInt(MantBits), nil), func() *big.Int { return MantDivisor }},
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 		for {
-			time.Sleep(1 * time.Minute)
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
 
 			// Verify that none of the values have mutated.
-			if Big0 == nil || big0.Cmp(Big0) != 0 ||
-				Big1 == nil || big1.Cmp(Big1) != 0 ||
-				Big2 == nil || big2.Cmp(Big2) != 0 ||
-				Big3 == nil || big3.Cmp(Big3) != 0 ||
-				Big8 == nil || big8.Cmp(Big8) != 0 ||
-				Big10 == nil || big10.Cmp(Big10) != 0 ||
-				Big32 == nil || big32.Cmp(Big32) != 0 ||
-				Big99 == nil || big99.Cmp(Big99) != 0 ||
-				Big100 == nil || big100.Cmp(Big100) != 0 ||
-				Big101 == nil || big101.Cmp(Big101) != 0 ||
-				Big256 == nil || big256.Cmp(Big256) != 0 ||
-				Big257 == nil || big257.Cmp(Big257) != 0 ||
-				Big2e64 == nil || big2e64.Cmp(Big2e64) != 0 ||
-				Big2e256 == nil || big2e256.Cmp(Big2e256) != 0 {
-				// Send a message to quitCh to abort.
-				log.Global.Error("A common value has mutated, exiting now")
-				quitCh <- struct{}{}
+			for _, e := range expected {
+				if v := e.got(); v == nil || e.value.Cmp(v) != 0 {
+					onCorrupt(e.name)
+					break
+				}
 			}
 		}
-	}(quitCh)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-done
+	}
+}
+
+// CompareChainWeight compares two chain weights that are already expressed in
+// the entropy domain. It returns -1 if weightA is lighter than weightB, +1 if it
+// is heavier, and 0 if the weights are equal. A nil weight is treated as the
+// lowest possible weight, so two nil weights compare as equal. Ties are not
+// broken here; callers must apply their own tie-breaker on a zero result.
+func CompareChainWeight(weightA, weightB *big.Int) int {
+	switch {
+	case weightA == nil && weightB == nil:
+		return 0
+	case weightA == nil:
+		return -1
+	case weightB == nil:
+		return 1
+	}
+	return weightA.Cmp(weightB)
+}
+
+// HashLeadingZeroEntropy returns the number of leading zero bits of the hash.
+// This is a cheap lower bound on the entropy of a PoW hash, which can be used to
+// reject obviously insufficient hashes before doing the exact LogBig math.
+func HashLeadingZeroEntropy(hash Hash) uint {
+	var zeros uint
+	for _, b := range hash {
+		if b != 0 {
+			return zeros + uint(bits.LeadingZeros8(b))
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// HashEntropyBytes returns the intrinsic entropy LogBig(2^256 / hash) of a PoW
+// hash, or nil if the hash is zero or does not meet the target. The hash is
+// converted into the caller provided scratch integer, which is overwritten, so
+// that the validation loop can reuse it instead of allocating per candidate.
+func HashEntropyBytes(hash *Hash, target *big.Int, scratch *big.Int) *big.Int {
+	scratch.SetBytes(hash[:])
+	if scratch.Sign() == 0 || scratch.Cmp(target) > 0 {
+		return nil
+	}
+	return LogBig(scratch.Quo(Big2e256, scratch))
+}
+
+// HashMeetsTarget reports whether the hash, interpreted as a big endian integer,
+// is less than or equal to the target. It compares the bytes directly, so it can
+// gate candidates before any big.Int based entropy math is done.
+func HashMeetsTarget(hash *Hash, target *Hash) bool {
+	return bytes.Compare(hash[:], target[:]) <= 0
 }
@@ -0,0 +1,1036 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCompareChainWeight(t *testing.T) {
+	tests := []struct {
+		a, b *big.Int
+		want int
+	}{
+		{big.NewInt(10), big.NewInt(10), 0},
+		{big.NewInt(9), big.NewInt(10), -1},
+		{big.NewInt(10), big.NewInt(9), 1},
+		{nil, big.NewInt(0), -1},
+		{big.NewInt(0), nil, 1},
+		{nil, nil, 0},
+	}
+	for i, test := range tests {
+		if have := CompareChainWeight(test.a, test.b); have != test.want {
+			t.Errorf("test %d: CompareChainWeight(%v, %v) = %d, want %d", i, test.a, test.b, have, test.want)
+		}
+	}
+}
+
+func TestHashLeadingZeroEntropy(t *testing.T) {
+	tests := []struct {
+		hash Hash
+		want uint
+	}{
+		{HexToHash("0x8000000000000000000000000000000000000000000000000000000000000000"), 0},
+		{HexToHash("0x4000000000000000000000000000000000000000000000000000000000000000"), 1},
+		{HexToHash("0x0100000000000000000000000000000000000000000000000000000000000000"), 7},
+		{HexToHash("0x0080000000000000000000000000000000000000000000000000000000000000"), 8},
+		{HexToHash("0x0010000000000000000000000000000000000000000000000000000000000000"), 11},
+		{HexToHash("0x0000000000000000000000000000000000000000000000000000000000000001"), 255},
+		{Hash{}, 256},
+	}
+	for i, test := range tests {
+		if have := HashLeadingZeroEntropy(test.hash); have != test.want {
+			t.Errorf("test %d: HashLeadingZeroEntropy(%x) = %d, want %d", i, test.hash, have, test.want)
+		}
+	}
+}
+
+func TestEntropyScaleBits(t *testing.T) {
+	want, _ := new(big.Int).SetString("18446744073709551616", 10)
+	if Big2e64.Cmp(want) != 0 {
+		t.Fatalf("Big2e64 drifted: have %v, want %v", Big2e64, want)
+	}
+	if have := new(big.Int).Lsh(Big1, EntropyScaleBits); have.Cmp(want) != 0 {
+		t.Fatalf("2^EntropyScaleBits drifted: have %v, want %v", have, want)
+	}
+}
+
+func TestHashEntropyBytes(t *testing.T) {
+	hash := HexToHash("0x0000ffff00000000000000000000000000000000000000000000000000000000")
+	target := new(big.Int).SetBytes(hash[:])
+	scratch := new(big.Int)
+
+	want := LogBig(new(big.Int).Quo(Big2e256, new(big.Int).SetBytes(hash[:])))
+	if have := HashEntropyBytes(&hash, target, scratch); have == nil || have.Cmp(want) != 0 {
+		t.Fatalf("entropy mismatch: have %v, want %v", have, want)
+	}
+	if have := HashEntropyBytes(&hash, new(big.Int).Sub(target, Big1), scratch); have != nil {
+		t.Fatalf("hash above target returned entropy %v", have)
+	}
+}
+
+func BenchmarkHashEntropy(b *testing.B) {
+	hash := HexToHash("0x00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+	target := new(big.Int).SetBytes(hash[:])
+
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			x := new(big.Int).SetBytes(hash.Bytes())
+			if x.Cmp(target) <= 0 {
+				LogBig(new(big.Int).Div(Big2e256, x))
+			}
+		}
+	})
+	b.Run("scratch", func(b *testing.B) {
+		b.ReportAllocs()
+		scratch := new(big.Int)
+		for i := 0; i < b.N; i++ {
+			HashEntropyBytes(&hash, target, scratch)
+		}
+	})
+}
+
+func TestReduceDifficultyRatio(t *testing.T) {
+	large, _ := new(big.Int).SetString("1000000000000000000000000000007", 10)
+	tests := []struct {
+		a, b     *big.Int
+		num, den *big.Int
+	}{
+		{big.NewInt(3), big.NewInt(2), big.NewInt(3), big.NewInt(2)},
+		{big.NewInt(6), big.NewInt(4), big.NewInt(3), big.NewInt(2)},
+		{new(big.Int).Mul(large, big.NewInt(3)), new(big.Int).Mul(large, big.NewInt(2)), big.NewInt(3), big.NewInt(2)},
+		{big.NewInt(5), big.NewInt(0), big.NewInt(5), big.NewInt(1)},
+		{big.NewInt(0), big.NewInt(5), big.NewInt(0), big.NewInt(1)},
+	}
+	for i, test := range tests {
+		num, den := ReduceDifficultyRatio(test.a, test.b)
+		if num.Cmp(test.num) != 0 || den.Cmp(test.den) != 0 {
+			t.Errorf("test %d: ReduceDifficultyRatio(%v, %v) = %v:%v, want %v:%v", i, test.a, test.b, num, den, test.num, test.den)
+		}
+	}
+}
+
+func TestSafeDivZeroDivisor(t *testing.T) {
+	if _, err := safeDiv(Big1, new(big.Int)); err != ErrDivideByZero {
+		t.Fatalf("expected ErrDivideByZero, got %v", err)
+	}
+
+	// Simulate a corrupted scaling constant
+	saved := new(big.Int).Set(Big2e64)
+	Big2e64.SetInt64(0)
+	defer Big2e64.Set(saved)
+
+	if have := BigBitsToBits(big.NewInt(12345)); have.Sign() != 0 {
+		t.Fatalf("expected zero fallback, got %v", have)
+	}
+}
+
+func TestBigBitsToRatZeroScale(t *testing.T) {
+	saved := new(big.Int).Set(Big2e64)
+	Big2e64.SetInt64(0)
+	defer Big2e64.Set(saved)
+
+	if have := BigBitsToRat(big.NewInt(12345)); have.Sign() != 0 {
+		t.Fatalf("expected zero fallback, got %v", have)
+	}
+	if have := EntropyString(big.NewInt(12345), 2); have != "0.00" {
+		t.Fatalf("EntropyString = %q, want %q", have, "0.00")
+	}
+}
+
+func TestInverseLogBigZeroScale(t *testing.T) {
+	bigBits := LogBig(big.NewInt(1000))
+	saved := new(big.Int).Set(Big2e64)
+	Big2e64.SetInt64(0)
+	defer Big2e64.Set(saved)
+
+	if have := CumulativeEntropyToTotalDifficulty(bigBits); have.Sign() != 0 {
+		t.Fatalf("expected zero fallback, got %v", have)
+	}
+}
+
+func TestFormatDifficulty(t *testing.T) {
+	peta, _ := new(big.Int).SetString("1230000000000000", 10)
+	tests := []struct {
+		diff *big.Int
+		want string
+	}{
+		{nil, "<nil>"},
+		{big.NewInt(0), "0 diff"},
+		{big.NewInt(999), "999 diff"},
+		{big.NewInt(1000), "1.00 Kdiff"},
+		{big.NewInt(1000000), "1.00 Mdiff"},
+		{peta, "1.23 Pdiff"},
+	}
+	for i, test := range tests {
+		if have := FormatDifficulty(test.diff); have != test.want {
+			t.Errorf("test %d: FormatDifficulty(%v) = %q, want %q", i, test.diff, have, test.want)
+		}
+	}
+}
+
+func TestClampEntropyDelta(t *testing.T) {
+	floor := big.NewInt(100)
+	tests := []struct {
+		delta *big.Int
+		want  *big.Int
+	}{
+		{big.NewInt(99), big.NewInt(0)},
+		{big.NewInt(100), big.NewInt(100)},
+		{big.NewInt(101), big.NewInt(101)},
+		{big.NewInt(-99), big.NewInt(0)},
+		{big.NewInt(-101), big.NewInt(-101)},
+	}
+	for i, test := range tests {
+		if have := ClampEntropyDelta(test.delta, floor); have.Cmp(test.want) != 0 {
+			t.Errorf("test %d: ClampEntropyDelta(%v) = %v, want %v", i, test.delta, have, test.want)
+		}
+	}
+	// Doubling the difficulty adds exactly one bit of entropy
+	if have := EntropyDelta(big.NewInt(1024), big.NewInt(2048)); have.Cmp(Big2e64) != 0 {
+		t.Errorf("EntropyDelta of a doubling = %v, want %v", have, Big2e64)
+	}
+}
+
+func TestBigBitsToRat(t *testing.T) {
+	// 2^60 bits plus the smallest representable fraction of a bit
+	values := []*big.Int{new(big.Int).Lsh(Big1, 124), big.NewInt(1)}
+
+	sum := new(big.Rat)
+	floatSum := new(big.Float)
+	for _, v := range values {
+		sum.Add(sum, BigBitsToRat(v))
+		floatSum.Add(floatSum, BigBitsToBitsFloat(v))
+	}
+	want := new(big.Rat).SetFrac(new(big.Int).Add(new(big.Int).Lsh(Big1, 124), Big1), Big2e64)
+	if sum.Cmp(want) != 0 {
+		t.Fatalf("rational sum mismatch: have %v, want %v", sum, want)
+	}
+	// The float path rounds the fraction away
+	f, _ := floatSum.Float64()
+	if exact, _ := want.Float64(); new(big.Rat).SetFloat64(exact).Cmp(want) == 0 || new(big.Rat).SetFloat64(f).Cmp(want) == 0 {
+		t.Fatalf("float path unexpectedly exact")
+	}
+}
+
+func TestCumulativeEntropyToTotalDifficulty(t *testing.T) {
+	bound := new(big.Float).SetMantExp(big.NewFloat(1), -50)
+	for _, diff := range []*big.Int{
+		big.NewInt(1),
+		big.NewInt(2),
+		big.NewInt(1000),
+		big.NewInt(123456789),
+		new(big.Int).Lsh(Big1, 100),
+		new(big.Int).Sub(new(big.Int).Lsh(Big1, 200), big.NewInt(12345)),
+	} {
+		td := CumulativeEntropyToTotalDifficulty(LogBig(diff))
+		relErr := new(big.Float).Quo(new(big.Float).SetInt(new(big.Int).Abs(new(big.Int).Sub(td, diff))), new(big.Float).SetInt(diff))
+		// Small difficulties are truncated to integers, allow an error of one
+		if relErr.Cmp(bound) > 0 && new(big.Int).Sub(td, diff).CmpAbs(Big1) > 0 {
+			t.Errorf("round trip of %v = %v, relative error %v above bound", diff, td, relErr)
+		}
+	}
+	// At the top of the range the mantissa rounds up to 2^64 in float64, which
+	// must not carry over into 2^256
+	maxDiff := new(big.Int).Sub(Big2e256, Big1)
+	for _, entropy := range []*big.Int{
+		LogBig(maxDiff),
+		new(big.Int).Sub(new(big.Int).Lsh(Big256, EntropyScaleBits), Big1),
+		new(big.Int).Lsh(big.NewInt(300), EntropyScaleBits),
+	} {
+		if td := CumulativeEntropyToTotalDifficulty(entropy); !IsValidDifficulty(td) || td.BitLen() != 256 {
+			t.Errorf("entropy %v: CumulativeEntropyToTotalDifficulty = %v, want a 256 bit difficulty", entropy, td)
+		}
+	}
+}
+
+func TestHashMeetsTarget(t *testing.T) {
+	target := HexToHash("0x0000000100000000000000000000000000000000000000000000000000000000")
+	below := HexToHash("0x00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff")
+	above := HexToHash("0x0000000100000000000000000000000000000000000000000000000000000001")
+
+	if !HashMeetsTarget(&target, &target) {
+		t.Error("hash equal to target rejected")
+	}
+	if !HashMeetsTarget(&below, &target) {
+		t.Error("hash one below target rejected")
+	}
+	if HashMeetsTarget(&above, &target) {
+		t.Error("hash one above target accepted")
+	}
+}
+
+func TestIsValidDifficulty(t *testing.T) {
+	tests := []struct {
+		diff *big.Int
+		want bool
+	}{
+		{nil, false},
+		{big.NewInt(-1), false},
+		{big.NewInt(0), false},
+		{big.NewInt(1), true},
+		{new(big.Int).Sub(Big2e256, Big1), true},
+		{new(big.Int).Set(Big2e256), false},
+	}
+	for i, test := range tests {
+		if have := IsValidDifficulty(test.diff); have != test.want {
+			t.Errorf("test %d: IsValidDifficulty(%v) = %v, want %v", i, test.diff, have, test.want)
+		}
+	}
+}
+
+func TestEntropyString(t *testing.T) {
+	// 3.375 bits
+	bigBits := new(big.Int).Add(new(big.Int).Mul(big.NewInt(3), Big2e64), new(big.Int).Rsh(new(big.Int).Mul(big.NewInt(3), Big2e64), 3))
+	tests := []struct {
+		decimals int
+		want     string
+	}{
+		{-1, "3"},
+		{0, "3"},
+		{1, "3.4"},
+		{2, "3.38"},
+		{3, "3.375"},
+		{5, "3.37500"},
+	}
+	for _, test := range tests {
+		if have := EntropyString(bigBits, test.decimals); have != test.want {
+			t.Errorf("EntropyString(%v, %d) = %q, want %q", bigBits, test.decimals, have, test.want)
+		}
+	}
+}
+
+func TestAddEntropyChecked(t *testing.T) {
+	max := new(big.Int).Mul(big.NewInt(1000), Big2e64)
+	total := new(big.Int).Mul(big.NewInt(900), Big2e64)
+
+	sum, err := AddEntropyChecked(total, LogBig(big.NewInt(1<<20)), max)
+	if err != nil {
+		t.Fatalf("plausible delta rejected: %v", err)
+	}
+	if want := new(big.Int).Mul(big.NewInt(920), Big2e64); sum.Cmp(want) != 0 {
+		t.Fatalf("sum mismatch: have %v, want %v", sum, want)
+	}
+	huge := LogBig(new(big.Int).Sub(Big2e256, Big1))
+	if _, err := AddEntropyChecked(total, huge, max); !errors.Is(err, ErrEntropyOverflow) {
+		t.Fatalf("huge delta not rejected, err %v", err)
+	}
+	if _, err := AddEntropyChecked(total, new(big.Int).Sub(max, total), max); err != nil {
+		t.Fatalf("sum equal to max rejected: %v", err)
+	}
+}
+
+func TestParseBigScientific(t *testing.T) {
+	want1540, _ := new(big.Int).SetString("15000000000000000000000000000000000000000", 10)
+	want10e978 := new(big.Int).Exp(big.NewInt(10), big.NewInt(978), nil)
+	tests := []struct {
+		input string
+		want  *big.Int
+		err   bool
+	}{
+		{"1.5e40", want1540, false},
+		{"15E39", want1540, false},
+		{"12345", big.NewInt(12345), false},
+		{"-2.5e1", big.NewInt(-25), false},
+		{"1.25e1", nil, true},
+		{"1.5", nil, true},
+		{"1e-3", nil, true},
+		{"1e999999999", nil, true},
+		{"1e99999999999999999999", nil, true},
+		{"1e-2000000000", nil, true},
+		{"5e-1500000000", nil, true},
+		{"1.5e-700000000", nil, true},
+		{"0.0000000000000000000001e1000", want10e978, false},
+		{"0.001e3", big.NewInt(1), false},
+		{"120e-1", big.NewInt(12), false},
+		{"0e999999999", big.NewInt(0), false},
+		{"Inf", nil, true},
+		{"-Inf", nil, true},
+		{"NaN", nil, true},
+		{"1.2.3", nil, true},
+		{"e5", nil, true},
+		{"abc", nil, true},
+	}
+	for _, test := range tests {
+		have, err := ParseBigScientific(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseBigScientific(%q) = %v, want error", test.input, have)
+			}
+			continue
+		}
+		if err != nil || have.Cmp(test.want) != 0 {
+			t.Errorf("ParseBigScientific(%q) = %v, %v, want %v", test.input, have, err, test.want)
+		}
+	}
+}
+
+func TestConversionResultsAreOwned(t *testing.T) {
+	diff := big.NewInt(123456789)
+	bigBits := new(big.Int).Mul(big.NewInt(42), Big2e64)
+
+	intConversions := map[string]func() *big.Int{
+		"LogBig":                         func() *big.Int { return LogBig(diff) },
+		"BitsToBigBits":                  func() *big.Int { return BitsToBigBits(diff) },
+		"BigBitsToBits":                  func() *big.Int { return BigBitsToBits(bigBits) },
+		"EntropyBigBitsToDifficultyBits": func() *big.Int { return EntropyBigBitsToDifficultyBits(bigBits) },
+		"BigBitsArrayToBitsArray":        func() *big.Int { return BigBitsArrayToBitsArray([]*big.Int{bigBits})[0] },
+		"MantDivisorCopy":                MantDivisorCopy,
+	}
+	for name, convert := range intConversions {
+		want := new(big.Int).Set(convert())
+		convert().SetInt64(-1)
+		if have := convert(); have.Cmp(want) != 0 {
+			t.Errorf("%s: mutating a result changed a later result: have %v, want %v", name, have, want)
+		}
+	}
+
+	want := BigBitsToBitsFloat(bigBits).String()
+	BigBitsToBitsFloat(bigBits).SetInt64(-1)
+	if have := BigBitsToBitsFloat(bigBits).String(); have != want {
+		t.Errorf("BigBitsToBitsFloat: mutating a result changed a later result: have %v, want %v", have, want)
+	}
+	wantRat := BigBitsToRat(bigBits).String()
+	BigBitsToRat(bigBits).SetInt64(-1)
+	if have := BigBitsToRat(bigBits).String(); have != wantRat {
+		t.Errorf("BigBitsToRat: mutating a result changed a later result: have %v, want %v", have, wantRat)
+	}
+}
+
+func TestGeometricMeanDifficulty(t *testing.T) {
+	maxDiff := new(big.Int).Sub(Big2e256, Big1)
+	tests := []struct {
+		difficulties []*big.Int
+		want         *big.Int
+	}{
+		{nil, nil},
+		{[]*big.Int{nil, big.NewInt(0)}, nil},
+		{[]*big.Int{big.NewInt(2), big.NewInt(8)}, big.NewInt(4)},
+		{[]*big.Int{big.NewInt(1), big.NewInt(4), big.NewInt(16)}, big.NewInt(4)},
+		{[]*big.Int{big.NewInt(1024), nil, big.NewInt(-5), big.NewInt(1 << 30)}, big.NewInt(1 << 20)},
+		// The float evaluation saturates one ulp below 2^256 instead of reaching it
+		{[]*big.Int{maxDiff, maxDiff}, new(big.Int).Sub(Big2e256, new(big.Int).Lsh(Big1, 203))},
+	}
+	for i, test := range tests {
+		have := GeometricMeanDifficulty(test.difficulties)
+		if (have == nil) != (test.want == nil) || (have != nil && have.Cmp(test.want) != 0) {
+			t.Errorf("test %d: GeometricMeanDifficulty = %v, want %v", i, have, test.want)
+		}
+	}
+}
+
+func TestLogBigExact(t *testing.T) {
+	for _, k := range []uint{0, 1, 2, 31, 32, 63, 64, 65, 128, 255} {
+		diff := new(big.Int).Lsh(big.NewInt(1), k)
+		want := new(big.Int).Lsh(new(big.Int).SetUint64(uint64(k)), MantBits)
+		have, exact := LogBigExact(diff)
+		if !exact || have.Cmp(want) != 0 {
+			t.Errorf("2^%d: LogBigExact = %v, %v, want %v, true", k, have, exact, want)
+		}
+		// Neighbours of a power of two are not exact and fall back to LogBig.
+		for _, neighbour := range []*big.Int{new(big.Int).Add(diff, big.NewInt(1)), new(big.Int).Sub(diff, big.NewInt(1))} {
+			if neighbour.Cmp(big.NewInt(3)) < 0 {
+				continue
+			}
+			have, exact := LogBigExact(neighbour)
+			if exact || have.Cmp(LogBig(neighbour)) != 0 {
+				t.Errorf("%v: LogBigExact = %v, %v, want %v, false", neighbour, have, exact, LogBig(neighbour))
+			}
+		}
+	}
+}
+
+func TestEntropyPercentChange(t *testing.T) {
+	tests := []struct {
+		old, new *big.Int
+		want     float64
+		err      bool
+	}{
+		{big.NewInt(1 << 32), big.NewInt(1 << 33), 3.125, false},
+		{big.NewInt(1 << 32), big.NewInt(1 << 31), -3.125, false},
+		{big.NewInt(1 << 20), big.NewInt(1 << 20), 0, false},
+		{big.NewInt(1), big.NewInt(2), 0, true},
+		{nil, big.NewInt(2), 0, true},
+		{big.NewInt(2), big.NewInt(0), 0, true},
+	}
+	for i, test := range tests {
+		have, err := EntropyPercentChange(test.old, test.new)
+		if (err != nil) != test.err || have != test.want {
+			t.Errorf("test %d: EntropyPercentChange = %v, %v, want %v, error %v", i, have, err, test.want, test.err)
+		}
+	}
+}
+
+func TestSignedEntropyDelta(t *testing.T) {
+	tests := []struct {
+		old, new *big.Int
+		want     *big.Int
+		sign     int
+	}{
+		{big.NewInt(1 << 10), big.NewInt(1 << 12), new(big.Int).Lsh(big.NewInt(2), MantBits), 1},
+		{big.NewInt(1 << 12), big.NewInt(1 << 10), new(big.Int).Lsh(big.NewInt(2), MantBits), -1},
+		{big.NewInt(1000), big.NewInt(1000), big.NewInt(0), 0},
+	}
+	for i, test := range tests {
+		have, sign := SignedEntropyDelta(test.old, test.new)
+		if have.Cmp(test.want) != 0 || sign != test.sign {
+			t.Errorf("test %d: SignedEntropyDelta = %v, %d, want %v, %d", i, have, sign, test.want, test.sign)
+		}
+		if delta := EntropyDelta(test.old, test.new); delta.Cmp(have) != 0 {
+			t.Errorf("test %d: EntropyDelta = %v, want %v", i, delta, have)
+		}
+	}
+}
+
+func TestPreviewDifficultyForBlockTime(t *testing.T) {
+	diff := new(big.Int).Lsh(big.NewInt(1), 40)
+	if have := PreviewDifficultyForBlockTime(diff, 10*time.Second, 10*time.Second); have.Cmp(diff) != 0 {
+		t.Errorf("on target: PreviewDifficultyForBlockTime = %v, want %v", have, diff)
+	}
+	faster := PreviewDifficultyForBlockTime(diff, 9*time.Second, 10*time.Second)
+	slower := PreviewDifficultyForBlockTime(diff, 11*time.Second, 10*time.Second)
+	if faster.Cmp(diff) <= 0 || slower.Cmp(diff) >= 0 {
+		t.Errorf("PreviewDifficultyForBlockTime = %v fast, %v slow, want above and below %v", faster, slower, diff)
+	}
+	// Extreme block times are clamped to the maximum step
+	maxUp := inverseLogBig(new(big.Int).Add(LogBig(diff), new(big.Int).Lsh(Big1, EntropyScaleBits-3)))
+	if have := PreviewDifficultyForBlockTime(diff, time.Millisecond, 10*time.Second); have.Cmp(maxUp) != 0 {
+		t.Errorf("clamped: PreviewDifficultyForBlockTime = %v, want %v", have, maxUp)
+	}
+	if have := PreviewDifficultyForBlockTime(diff, 0, 10*time.Second); have.Cmp(maxUp) != 0 {
+		t.Errorf("zero block time: PreviewDifficultyForBlockTime = %v, want %v", have, maxUp)
+	}
+	if have := PreviewDifficultyForBlockTime(diff, time.Second, 0); have != nil {
+		t.Errorf("zero target: PreviewDifficultyForBlockTime = %v, want nil", have)
+	}
+}
+
+func TestDifficultyCompact(t *testing.T) {
+	tests := []struct {
+		diff *big.Int
+		enc  []byte
+	}{
+		{big.NewInt(0), []byte{0x00}},
+		{big.NewInt(1), []byte{0x01, 0x01}},
+		{big.NewInt(0x1234), []byte{0x02, 0x12, 0x34}},
+		{nil, nil},
+		{big.NewInt(-1), nil},
+		{new(big.Int).Lsh(Big1, 8*255), nil},
+	}
+	for i, test := range tests {
+		if have := EncodeDifficultyCompact(test.diff); !bytes.Equal(have, test.enc) {
+			t.Errorf("test %d: EncodeDifficultyCompact = %x, want %x", i, have, test.enc)
+		}
+	}
+	for _, malformed := range [][]byte{nil, {0x02, 0x01}, {0x01}, {0x01, 0x00}, {0x02, 0x00, 0x01}} {
+		if have := DecodeDifficultyCompact(malformed); have != nil {
+			t.Errorf("DecodeDifficultyCompact(%x) = %v, want nil", malformed, have)
+		}
+	}
+}
+
+func FuzzDifficultyCompact(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x01})
+	f.Add(Big2e64.Bytes())
+	f.Add(new(big.Int).Sub(Big2e256, Big1).Bytes())
+	f.Add(bytes.Repeat([]byte{0xff}, 255))
+	f.Fuzz(func(t *testing.T, magnitude []byte) {
+		diff := new(big.Int).SetBytes(magnitude)
+		enc := EncodeDifficultyCompact(diff)
+		if len(diff.Bytes()) > 255 {
+			if enc != nil {
+				t.Fatalf("oversized difficulty encoded: %x", enc)
+			}
+			return
+		}
+		if dec := DecodeDifficultyCompact(enc); dec == nil || dec.Cmp(diff) != 0 {
+			t.Fatalf("round trip of %v yielded %v", diff, dec)
+		}
+		// Arbitrary input must either be rejected or be canonical.
+		if dec := DecodeDifficultyCompact(magnitude); dec != nil && !bytes.Equal(EncodeDifficultyCompact(dec), magnitude) {
+			t.Fatalf("non canonical encoding %x accepted", magnitude)
+		}
+	})
+}
+
+func TestInterpolateDifficulty(t *testing.T) {
+	a, b := big.NewInt(1000003), new(big.Int).Lsh(big.NewInt(12345), 100)
+	for _, pos := range []float64{-1, 0} {
+		if have := InterpolateDifficulty(a, b, pos); have.Cmp(a) != 0 {
+			t.Errorf("t=%v: InterpolateDifficulty = %v, want %v", pos, have, a)
+		}
+	}
+	for _, pos := range []float64{1, 2} {
+		if have := InterpolateDifficulty(a, b, pos); have.Cmp(b) != 0 {
+			t.Errorf("t=%v: InterpolateDifficulty = %v, want %v", pos, have, b)
+		}
+	}
+	if have := InterpolateDifficulty(big.NewInt(2), big.NewInt(8), 0.5); have.Cmp(big.NewInt(4)) != 0 {
+		t.Errorf("midpoint: InterpolateDifficulty = %v, want 4", have)
+	}
+	if have := InterpolateDifficulty(nil, b, 0.5); have != nil {
+		t.Errorf("invalid: InterpolateDifficulty = %v, want nil", have)
+	}
+}
+
+func TestEntropyTotalPlausible(t *testing.T) {
+	minPerBlock, maxPerBlock := big.NewInt(10), big.NewInt(20)
+	tests := []struct {
+		total *big.Int
+		count uint64
+		want  bool
+	}{
+		{big.NewInt(99), 10, false},
+		{big.NewInt(100), 10, true},
+		{big.NewInt(150), 10, true},
+		{big.NewInt(200), 10, true},
+		{big.NewInt(201), 10, false},
+		{new(big.Int).Lsh(Big1, 300), 10, false},
+		{big.NewInt(0), 0, true},
+		{nil, 10, false},
+	}
+	for i, test := range tests {
+		if have := EntropyTotalPlausible(test.total, test.count, minPerBlock, maxPerBlock); have != test.want {
+			t.Errorf("test %d: EntropyTotalPlausible(%v, %d) = %v, want %v", i, test.total, test.count, have, test.want)
+		}
+	}
+}
+
+func TestAddDifficultySaturating(t *testing.T) {
+	maxDiff := new(big.Int).Sub(Big2e256, Big1)
+	tests := []struct {
+		a, b      *big.Int
+		want      *big.Int
+		saturated bool
+	}{
+		{big.NewInt(2), big.NewInt(3), big.NewInt(5), false},
+		{maxDiff, big.NewInt(0), maxDiff, false},
+		{maxDiff, big.NewInt(1), maxDiff, true},
+		{maxDiff, maxDiff, maxDiff, true},
+	}
+	for i, test := range tests {
+		have, saturated := AddDifficultySaturating(test.a, test.b)
+		if have.Cmp(test.want) != 0 || saturated != test.saturated {
+			t.Errorf("test %d: AddDifficultySaturating = %v, %v, want %v, %v", i, have, saturated, test.want, test.saturated)
+		}
+	}
+	if maxDiff.Cmp(new(big.Int).Sub(Big2e256, Big1)) != 0 {
+		t.Errorf("input modified: %v", maxDiff)
+	}
+}
+
+func TestClampDifficultyBand(t *testing.T) {
+	center, halfWidth := big.NewInt(1<<20), new(big.Int).Lsh(big.NewInt(2), MantBits)
+	tests := []struct {
+		diff *big.Int
+		want *big.Int
+	}{
+		{big.NewInt(1 << 21), big.NewInt(1 << 21)},
+		{big.NewInt(1<<22 - 1), big.NewInt(1<<22 - 1)},
+		{big.NewInt(1 << 30), big.NewInt(1 << 22)},
+		{big.NewInt(1 << 10), big.NewInt(1 << 18)},
+		{big.NewInt(0), nil},
+	}
+	for i, test := range tests {
+		have := ClampDifficultyBand(test.diff, center, halfWidth)
+		if (have == nil) != (test.want == nil) || (have != nil && have.Cmp(test.want) != 0) {
+			t.Errorf("test %d: ClampDifficultyBand = %v, want %v", i, have, test.want)
+		}
+	}
+	if have := ClampDifficultyBand(center, center, big.NewInt(-1)); have != nil {
+		t.Errorf("negative width: ClampDifficultyBand = %v, want nil", have)
+	}
+}
+
+func TestBigBitsToBitsRoundEven(t *testing.T) {
+	half := new(big.Int).Rsh(Big2e64, 1)
+	bigBits := func(bits int64, frac *big.Int) *big.Int {
+		return new(big.Int).Add(new(big.Int).Mul(big.NewInt(bits), Big2e64), frac)
+	}
+	tests := []struct {
+		original *big.Int
+		want     int64
+	}{
+		{bigBits(2, half), 2},
+		{bigBits(3, half), 4},
+		{bigBits(0, half), 0},
+		{bigBits(1, half), 2},
+		{bigBits(2, new(big.Int).Sub(half, Big1)), 2},
+		{bigBits(2, new(big.Int).Add(half, Big1)), 3},
+		{bigBits(-1, half), 0},
+		{bigBits(-2, half), -2},
+		{bigBits(5, big.NewInt(0)), 5},
+	}
+	for i, test := range tests {
+		if have := BigBitsToBitsRoundEven(test.original); have.Cmp(big.NewInt(test.want)) != 0 {
+			t.Errorf("test %d: BigBitsToBitsRoundEven(%v) = %v, want %d", i, test.original, have, test.want)
+		}
+	}
+}
+
+func TestBigBitsToBitsWith(t *testing.T) {
+	half := new(big.Int).Rsh(Big2e64, 1)
+	// 2.5 and 3.5 bits, and just above 2.5 bits
+	twoHalf := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(2), 64), half)
+	threeHalf := new(big.Int).Add(twoHalf, Big2e64)
+	aboveTwoHalf := new(big.Int).Add(twoHalf, Big1)
+	tests := []struct {
+		original *big.Int
+		policy   RoundingPolicy
+		want     int64
+	}{
+		{twoHalf, RoundTruncate, 2},
+		{twoHalf, RoundHalfUp, 3},
+		{twoHalf, RoundHalfEven, 2},
+		{threeHalf, RoundTruncate, 3},
+		{threeHalf, RoundHalfUp, 4},
+		{threeHalf, RoundHalfEven, 4},
+		{aboveTwoHalf, RoundTruncate, 2},
+		{aboveTwoHalf, RoundHalfUp, 3},
+		{aboveTwoHalf, RoundHalfEven, 3},
+	}
+	for i, test := range tests {
+		if have := BigBitsToBitsWith(test.original, test.policy); have.Cmp(big.NewInt(test.want)) != 0 {
+			t.Errorf("test %d: BigBitsToBitsWith(%v, %d) = %v, want %d", i, test.original, test.policy, have, test.want)
+		}
+	}
+	if have := BigBitsToBits(threeHalf); have.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("BigBitsToBits = %v, want 3", have)
+	}
+}
+
+func TestUncleEntropyContribution(t *testing.T) {
+	diff := big.NewInt(1000003)
+	half := UncleEntropyContribution(diff, big.NewInt(1), big.NewInt(2))
+	if want := new(big.Int).Rsh(LogBig(diff), 1); half.Cmp(want) != 0 {
+		t.Errorf("50%% discount: UncleEntropyContribution = %v, want %v", half, want)
+	}
+	if full := UncleEntropyContribution(diff, big.NewInt(3), big.NewInt(3)); full.Cmp(LogBig(diff)) != 0 {
+		t.Errorf("no discount: UncleEntropyContribution = %v, want %v", full, LogBig(diff))
+	}
+	if zero := UncleEntropyContribution(diff, big.NewInt(1), big.NewInt(0)); zero.Sign() != 0 {
+		t.Errorf("zero denominator: UncleEntropyContribution = %v, want 0", zero)
+	}
+}
+
+func FuzzChainWeight(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(Big2e64.Bytes())
+	f.Add(new(big.Int).Sub(Big2e256, Big1).Bytes())
+	f.Add(Big2e256.Bytes())
+	f.Fuzz(func(t *testing.T, magnitude []byte) {
+		weight := new(big.Int).SetBytes(magnitude)
+		enc := EncodeChainWeight(weight)
+		if weight.Cmp(Big2e256) >= 0 {
+			if enc != nil {
+				t.Fatalf("oversized weight encoded: %x", enc)
+			}
+		} else if dec, err := DecodeChainWeight(enc); err != nil || dec.Cmp(weight) != 0 {
+			t.Fatalf("round trip of %v yielded %v, %v", weight, dec, err)
+		}
+		if dec, err := DecodeChainWeight(magnitude); err == nil {
+			if len(magnitude) > 33 || !bytes.Equal(EncodeChainWeight(dec), magnitude) {
+				t.Fatalf("invalid encoding %x accepted", magnitude)
+			}
+		} else if !errors.Is(err, ErrInvalidChainWeight) {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestDecodeChainWeightOversized(t *testing.T) {
+	if _, err := DecodeChainWeight(EncodeDifficultyCompact(Big2e256)); !errors.Is(err, ErrInvalidChainWeight) {
+		t.Errorf("2^256 weight decoded, err %v", err)
+	}
+	if _, err := DecodeChainWeight(make([]byte, 1<<20)); !errors.Is(err, ErrInvalidChainWeight) {
+		t.Errorf("oversized blob decoded, err %v", err)
+	}
+}
+
+func TestCheckEntropyMonotonic(t *testing.T) {
+	tests := []struct {
+		difficulties []*big.Int
+		index        int
+		regressed    bool
+	}{
+		{nil, -1, false},
+		{[]*big.Int{big.NewInt(1), big.NewInt(1000), big.NewInt(7)}, -1, false},
+		{[]*big.Int{big.NewInt(1000), big.NewInt(1000), big.NewInt(0), big.NewInt(1000)}, 2, true},
+		{[]*big.Int{big.NewInt(1000), big.NewInt(-5), nil}, 1, true},
+		{[]*big.Int{big.NewInt(1000), nil}, 1, true},
+		// A difficulty of one adds no entropy, which is not a regression
+		{[]*big.Int{big.NewInt(1000), big.NewInt(1), big.NewInt(1000)}, -1, false},
+		{[]*big.Int{new(big.Int).Sub(Big2e256, Big1), Big2e256}, -1, false},
+	}
+	for i, test := range tests {
+		index, regressed := CheckEntropyMonotonic(test.difficulties)
+		if index != test.index || regressed != test.regressed {
+			t.Errorf("test %d: CheckEntropyMonotonic = %d, %v, want %d, %v", i, index, regressed, test.index, test.regressed)
+		}
+	}
+}
+
+func TestLogBigToUnits(t *testing.T) {
+	tests := []struct {
+		diff *big.Int
+		want float64
+	}{
+		{big.NewInt(1), 0},
+		{big.NewInt(2), 1},
+		{big.NewInt(1024), 10},
+		{new(big.Int).Lsh(Big1, 255), 255},
+	}
+	for i, test := range tests {
+		if have := LogBigToUnits(test.diff); have != test.want {
+			t.Errorf("test %d: LogBigToUnits = %v, want %v", i, have, test.want)
+		}
+	}
+	// log2(3) = 1.5849625007...
+	if have := LogBigToUnits(big.NewInt(3)); math.Abs(have-1.5849625007211562) > 1e-12 {
+		t.Errorf("LogBigToUnits(3) = %v, want %v", have, 1.5849625007211562)
+	}
+}
+
+func TestNormalizedDifficultyScore(t *testing.T) {
+	reference := big.NewInt(1 << 40)
+	tests := []struct {
+		diff *big.Int
+		want float64
+	}{
+		{big.NewInt(1 << 40), 1},
+		{big.NewInt(1 << 10), 0.25},
+		{big.NewInt(1 << 20), 0.5},
+		{big.NewInt(1), 0},
+		{new(big.Int).Lsh(Big1, 100), 1},
+		{big.NewInt(0), 0},
+	}
+	for i, test := range tests {
+		if have := NormalizedDifficultyScore(test.diff, reference); have != test.want {
+			t.Errorf("test %d: NormalizedDifficultyScore(%v) = %v, want %v", i, test.diff, have, test.want)
+		}
+	}
+}
+
+func TestEntropyPerEncodedByte(t *testing.T) {
+	tests := []struct {
+		diff *big.Int
+		want float64
+	}{
+		// 16 bits of entropy over a length byte and 3 magnitude bytes
+		{big.NewInt(1 << 16), 4},
+		// 64 bits of entropy over a length byte and 9 magnitude bytes
+		{Big2e64, 6.4},
+		{big.NewInt(1), 0},
+		{big.NewInt(0), 0},
+		{nil, 0},
+	}
+	for i, test := range tests {
+		if have := EntropyPerEncodedByte(test.diff); have != test.want {
+			t.Errorf("test %d: EntropyPerEncodedByte(%v) = %v, want %v", i, test.diff, have, test.want)
+		}
+	}
+}
+
+func TestHarmonicMeanIntervals(t *testing.T) {
+	// Intervals of 1, 2 and 4 have a harmonic mean of 3 / (1 + 1/2 + 1/4) = 12/7
+	have, err := HarmonicMeanIntervals([]uint64{100, 101, 103, 107})
+	if err != nil || have != 12.0/7 {
+		t.Errorf("HarmonicMeanIntervals = %v, %v, want %v", have, err, 12.0/7)
+	}
+	for _, timestamps := range [][]uint64{nil, {5}, {5, 7, 6}, {5, 5}} {
+		if _, err := HarmonicMeanIntervals(timestamps); err == nil {
+			t.Errorf("HarmonicMeanIntervals(%v) succeeded", timestamps)
+		}
+	}
+}
+
+func TestEntropyRoundTripError(t *testing.T) {
+	for _, diff := range []*big.Int{big.NewInt(2), big.NewInt(1000003), new(big.Int).Lsh(big.NewInt(12345), 100), new(big.Int).Sub(Big2e256, Big1)} {
+		entropy := LogBig(diff)
+		residual := EntropyRoundTripError(entropy)
+		if residual.Sign() < 0 || residual.Cmp(Big2e64) >= 0 {
+			t.Errorf("%v: EntropyRoundTripError = %v, want within [0, 2^64)", diff, residual)
+		}
+		restored := new(big.Int).Add(new(big.Int).Mul(BigBitsToBits(entropy), Big2e64), residual)
+		if restored.Cmp(entropy) != 0 {
+			t.Errorf("%v: residual %v does not restore %v", diff, residual, entropy)
+		}
+	}
+	if residual := EntropyRoundTripError(new(big.Int).Lsh(big.NewInt(7), 64)); residual.Sign() != 0 {
+		t.Errorf("whole bits: EntropyRoundTripError = %v, want 0", residual)
+	}
+}
+
+func TestWeightedAverageDifficulty(t *testing.T) {
+	difficulties := []*big.Int{big.NewInt(1 << 4), big.NewInt(1 << 16)}
+
+	equal, err := WeightedAverageDifficulty(difficulties, []*big.Int{big.NewInt(3), big.NewInt(3)})
+	if err != nil || equal.Cmp(GeometricMeanDifficulty(difficulties)) != 0 {
+		t.Errorf("equal weights: WeightedAverageDifficulty = %v, %v, want %v", equal, err, GeometricMeanDifficulty(difficulties))
+	}
+	// Entropies of 4 and 16 bits weighted 1:3 average to 13 bits
+	skewed, err := WeightedAverageDifficulty(difficulties, []*big.Int{big.NewInt(1), big.NewInt(3)})
+	if err != nil || skewed.Cmp(big.NewInt(1<<13)) != 0 {
+		t.Errorf("skewed weights: WeightedAverageDifficulty = %v, %v, want %v", skewed, err, 1<<13)
+	}
+	if _, err := WeightedAverageDifficulty(difficulties, []*big.Int{big.NewInt(1)}); err == nil {
+		t.Error("mismatched lengths accepted")
+	}
+	if _, err := WeightedAverageDifficulty(difficulties, []*big.Int{big.NewInt(0), big.NewInt(0)}); !errors.Is(err, ErrDivideByZero) {
+		t.Errorf("zero weights: err %v, want %v", err, ErrDivideByZero)
+	}
+}
+
+func TestSimulateDifficultySeries(t *testing.T) {
+	bits := func(n int64) *big.Int { return new(big.Int).Lsh(big.NewInt(n), MantBits) }
+	maxDiff := new(big.Int).Sub(Big2e256, Big1)
+	tests := []struct {
+		start  *big.Int
+		deltas []*big.Int
+		want   []*big.Int
+	}{
+		{big.NewInt(1 << 10), nil, []*big.Int{}},
+		{big.NewInt(1 << 10), []*big.Int{bits(1), bits(2), big.NewInt(0)}, []*big.Int{big.NewInt(1 << 11), big.NewInt(1 << 13), big.NewInt(1 << 13)}},
+		// Negative deltas lower the difficulty, down to a floor of one
+		{big.NewInt(1 << 10), []*big.Int{bits(-3), bits(-100), bits(4)}, []*big.Int{big.NewInt(1 << 7), big.NewInt(1), big.NewInt(1 << 4)}},
+		// Entropies past 256 bits are capped, but keep accumulating
+		{new(big.Int).Lsh(Big1, 250), []*big.Int{bits(10), bits(-4), bits(-10)}, []*big.Int{maxDiff, maxDiff, new(big.Int).Lsh(Big1, 246)}},
+		{big.NewInt(0), []*big.Int{bits(1)}, nil},
+	}
+	for i, test := range tests {
+		deltas := make([]*big.Int, len(test.deltas))
+		for j, delta := range test.deltas {
+			deltas[j] = new(big.Int).Set(delta)
+		}
+		have := SimulateDifficultySeries(test.start, test.deltas)
+		if (have == nil) != (test.want == nil) || len(have) != len(test.want) {
+			t.Errorf("test %d: SimulateDifficultySeries = %v, want %v", i, have, test.want)
+			continue
+		}
+		for j := range have {
+			if have[j].Cmp(test.want[j]) != 0 {
+				t.Errorf("test %d: step %d = %v, want %v", i, j, have[j], test.want[j])
+			}
+		}
+		for j := range deltas {
+			if deltas[j].Cmp(test.deltas[j]) != 0 {
+				t.Errorf("test %d: delta %d mutated to %v", i, j, test.deltas[j])
+			}
+		}
+	}
+}
+
+func TestDifficultyForHalvedBlockTime(t *testing.T) {
+	for _, k := range []uint{0, 1, 10, 63, 64, 200} {
+		diff := new(big.Int).Lsh(Big1, k)
+		if have, want := DifficultyForHalvedBlockTime(diff), new(big.Int).Lsh(diff, 1); have.Cmp(want) != 0 {
+			t.Errorf("2^%d: DifficultyForHalvedBlockTime = %v, want %v", k, have, want)
+		}
+	}
+	maxDiff := new(big.Int).Sub(Big2e256, Big1)
+	for _, diff := range []*big.Int{new(big.Int).Lsh(Big1, 255), maxDiff} {
+		if have := DifficultyForHalvedBlockTime(diff); have.Cmp(maxDiff) != 0 {
+			t.Errorf("%v: DifficultyForHalvedBlockTime = %v, want %v", diff, have, maxDiff)
+		}
+	}
+	if have := DifficultyForHalvedBlockTime(big.NewInt(0)); have != nil {
+		t.Errorf("invalid: DifficultyForHalvedBlockTime = %v, want nil", have)
+	}
+}
+
+func TestEntropyBudgetConsumed(t *testing.T) {
+	// Difficulties of 2^8 and 2^24 consume 32 bits of entropy
+	difficulties := []*big.Int{big.NewInt(1 << 8), big.NewInt(1 << 24)}
+	tests := []struct {
+		budget   *big.Int
+		fraction float64
+		exceeded bool
+	}{
+		{new(big.Int).Lsh(big.NewInt(64), MantBits), 0.5, false},
+		{new(big.Int).Lsh(big.NewInt(32), MantBits), 1, false},
+		{new(big.Int).Lsh(big.NewInt(16), MantBits), 2, true},
+		{big.NewInt(0), 0, true},
+	}
+	for i, test := range tests {
+		fraction, exceeded := EntropyBudgetConsumed(difficulties, test.budget)
+		if fraction != test.fraction || exceeded != test.exceeded {
+			t.Errorf("test %d: EntropyBudgetConsumed = %v, %v, want %v, %v", i, fraction, exceeded, test.fraction, test.exceeded)
+		}
+	}
+}
+
+func TestEntropyToExpectedHashes(t *testing.T) {
+	half := new(big.Int).Rsh(Big2e64, 1)
+	tests := []struct {
+		entropyBits *big.Int
+		want        *big.Int
+	}{
+		{new(big.Int).Lsh(big.NewInt(20), MantBits), big.NewInt(1 << 20)},
+		// 2^20.5 = 1482910.40...
+		{new(big.Int).Add(new(big.Int).Lsh(big.NewInt(20), MantBits), half), big.NewInt(1482910)},
+		{big.NewInt(0), big.NewInt(1)},
+		{big.NewInt(-5), big.NewInt(1)},
+		{new(big.Int).Lsh(big.NewInt(256), MantBits), new(big.Int).Sub(Big2e256, Big1)},
+		{new(big.Int).Lsh(big.NewInt(1000), MantBits), new(big.Int).Sub(Big2e256, Big1)},
+	}
+	for i, test := range tests {
+		if have := EntropyToExpectedHashes(test.entropyBits); have.Cmp(test.want) != 0 {
+			t.Errorf("test %d: EntropyToExpectedHashes = %v, want %v", i, have, test.want)
+		}
+	}
+	// 255 bits plus the largest mantissa rounds up to 2^256 in float64
+	top := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(255), MantBits), new(big.Int).Sub(Big2e64, Big1))
+	if have := EntropyToExpectedHashes(top); !IsValidDifficulty(have) || have.BitLen() != 256 {
+		t.Errorf("top of range: EntropyToExpectedHashes = %v, want a 256 bit difficulty", have)
+	}
+}
+
+func TestEntropyDeltaInDoublings(t *testing.T) {
+	diff := big.NewInt(1 << 30)
+	tests := []struct {
+		new  *big.Int
+		want float64
+	}{
+		{big.NewInt(1 << 31), 1},
+		{big.NewInt(1 << 32), 2},
+		{big.NewInt(1 << 30), 0},
+		{big.NewInt(1 << 29), -1},
+	}
+	for i, test := range tests {
+		if have, err := EntropyDeltaInDoublings(diff, test.new); err != nil || have != test.want {
+			t.Errorf("test %d: EntropyDeltaInDoublings = %v, %v, want %v", i, have, err, test.want)
+		}
+	}
+	if _, err := EntropyDeltaInDoublings(diff, big.NewInt(0)); err == nil {
+		t.Error("invalid difficulty accepted")
+	}
+}
+
+func TestSanityCheckWithHandler(t *testing.T) {
+	// Corrupt a value before the checker starts. Cleanups run in reverse, so
+	// the checker is stopped before the value is restored and never observes
+	// or races with the restore.
+	Big257.SetInt64(0)
+	t.Cleanup(func() { Big257.SetInt64(257) })
+	corrupted := make(chan string, 1)
+	stop := SanityCheckWithHandler(time.Millisecond, func(name string) {
+		select {
+		case corrupted <- name:
+		default:
+		}
+	})
+	t.Cleanup(stop)
+	select {
+	case name := <-corrupted:
+		if name != "Big257" {
+			t.Errorf("handler reported %q, want %q", name, "Big257")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not invoked for corrupted value")
+	}
+}
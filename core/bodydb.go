@@ -94,6 +94,7 @@ func (bc *BodyDb) Append(block *types.WorkObject) ([]*types.Log, []common.Unlock
 			return nil, nil, err
 		}
 		rawdb.WriteTxLookupEntriesByBlock(batch, block, nodeCtx)
+		rawdb.WriteTxIndexHighWater(bc.db, batch, block.NumberU64(nodeCtx))
 	}
 	bc.logger.WithFields(log.Fields{
 		"block":      block.Number,
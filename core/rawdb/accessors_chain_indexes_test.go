@@ -1,13 +1,21 @@
 package rawdb
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"math"
 	"math/big"
+	"sort"
 	"testing"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/bitutil"
+	"github.com/dominant-strategies/go-quai/core/bloombits"
 	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
 	"github.com/dominant-strategies/go-quai/ethdb"
 	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/params"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
 )
@@ -120,3 +128,1394 @@ func testNilReadTransaction(t *testing.T, db ethdb.Database, hash common.Hash) {
 	require.Equal(t, uint64(0), rnumber, "Non-zero block number returned")
 	require.Equal(t, uint64(0), rindex, "Non-negative transaction index returned")
 }
+
+func TestHashTxLookupIndex(t *testing.T) {
+	v6db := NewMemoryDatabase(log.Global)
+	legacydb := NewMemoryDatabase(log.Global)
+
+	hashes := []common.Hash{{1}, {2}, {3}}
+	WriteTxLookupEntries(v6db, 7, hashes)
+
+	// Store the same index in the v4-v5 format, referencing the block hash
+	blockHash := common.Hash{0xbb}
+	WriteHeaderNumber(legacydb, blockHash, 7)
+	for _, hash := range hashes {
+		writeTxLookupEntry(legacydb, hash, blockHash.Bytes())
+	}
+
+	v6digest, err := HashTxLookupIndex(v6db)
+	require.NoError(t, err)
+	legacydigest, err := HashTxLookupIndex(legacydb)
+	require.NoError(t, err)
+	require.Equal(t, v6digest, legacydigest, "Equivalent indexes hashed differently")
+
+	WriteTxLookupEntries(v6db, 8, []common.Hash{{4}})
+	changed, err := HashTxLookupIndex(v6db)
+	require.NoError(t, err)
+	require.NotEqual(t, v6digest, changed, "Modified index hashed identically")
+}
+
+func TestTxReorgedOutMarkers(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+
+	require.Nil(t, ReadTxReorgedOut(db, common.Hash{1}), "Non existent marker returned")
+
+	MarkTxReorgedOut(db, common.Hash{1}, 10)
+	MarkTxReorgedOut(db, common.Hash{2}, 20)
+
+	number := ReadTxReorgedOut(db, common.Hash{1})
+	require.NotNil(t, number, "Marker not found")
+	require.Equal(t, uint64(10), *number)
+
+	swept, err := SweepTxReorgedMarkers(db, 25, 10)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	require.Nil(t, ReadTxReorgedOut(db, common.Hash{1}), "Expired marker not swept")
+	require.NotNil(t, ReadTxReorgedOut(db, common.Hash{2}), "Live marker swept")
+}
+
+func TestClassifyTxLookupEntry(t *testing.T) {
+	v3entry, err := proto.Marshal(&ProtoLegacyTxLookupEntry{BlockIndex: 4, Hash: &common.ProtoHash{Value: common.Hash{5}.Bytes()}})
+	require.NoError(t, err)
+	mangled := make([]byte, common.HashLength)
+	mangled[common.HashLength-1] = 7
+
+	tests := []struct {
+		data       []byte
+		format     string
+		number     *uint64
+		suspicious bool
+	}{
+		{nil, TxLookupFormatEmpty, nil, false},
+		{[]byte{0x01, 0x02}, TxLookupFormatV6, func() *uint64 { n := uint64(0x0102); return &n }(), false},
+		{[]byte{0x00, 0x02}, TxLookupFormatV6, func() *uint64 { n := uint64(0x02); return &n }(), true},
+		{common.Hash{0xaa}.Bytes(), TxLookupFormatV4, nil, false},
+		{mangled, TxLookupFormatV4, nil, true},
+		{v3entry, TxLookupFormatV3, func() *uint64 { n := uint64(4); return &n }(), false},
+		{bytes.Repeat([]byte{0xff}, common.HashLength+1), TxLookupFormatInvalid, nil, true},
+	}
+	for i, test := range tests {
+		format, number, suspicious := ClassifyTxLookupEntry(test.data)
+		require.Equalf(t, test.format, format, "test %d: wrong format", i)
+		require.Equalf(t, test.number, number, "test %d: wrong block number", i)
+		require.Equalf(t, test.suspicious, suspicious, "test %d: wrong suspicious flag", i)
+	}
+}
+
+func TestTxLookupMultiValue(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx := createTransaction(1)
+
+	canonical := createBlockWithTransactions(types.Transactions{tx})
+	canonical.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	WriteWorkObject(db, canonical.Hash(), canonical, types.BlockObject, common.ZONE_CTX)
+	WriteCanonicalHash(db, canonical.Hash(), 1)
+	WriteTxLookupEntriesMultiValue(db, 1, []common.Hash{tx.Hash()})
+
+	// The same transaction on a side chain overwrites the single-value entry
+	WriteTxLookupEntriesMultiValue(db, 2, []common.Hash{tx.Hash()})
+
+	require.ElementsMatch(t, []uint64{1, 2}, ReadTxLookupEntries(db, tx.Hash()))
+	entry := ReadTxLookupEntryMultiValue(db, tx.Hash())
+	require.NotNil(t, entry, "Lookup entry not found")
+	require.Equal(t, uint64(1), *entry, "Non-canonical lookup entry returned")
+	entry = ReadTxLookupEntry(db, tx.Hash())
+	require.NotNil(t, entry, "Lookup entry not found")
+	require.Equal(t, uint64(2), *entry, "Single-value lookup consulted the list")
+
+	// Deleting through a batch must remove the list entries as well
+	batch := db.NewBatch()
+	DeleteTxLookupEntryMultiValue(db, batch, tx.Hash())
+	require.NoError(t, batch.Write())
+	require.Nil(t, ReadTxLookupEntryMultiValue(db, tx.Hash()), "Deleted lookup returned")
+	require.Empty(t, ReadTxLookupEntries(db, tx.Hash()), "Deleted lookup list returned")
+	it := db.NewIterator(txLookupListPrefix, nil)
+	defer it.Release()
+	require.False(t, it.Next(), "Lookup list entry leaked")
+}
+
+func TestPopulatedBloomBits(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	require.Empty(t, PopulatedBloomBits(db))
+
+	for _, bit := range []uint{7, 2, 2047} {
+		for section := uint64(0); section < 3; section++ {
+			WriteBloomBits(db, bit, section, common.Hash{byte(section)}, []byte{0x01})
+		}
+	}
+	// Malformed keys within the bloom bits key space must be skipped
+	db.Put(append(bloomBitsKey(5, 0, common.Hash{}), 0x00), []byte{0x01})
+
+	require.Equal(t, []uint{2, 7, 2047}, PopulatedBloomBits(db))
+
+	WriteBloomBits(db, 2, 1, common.Hash{0xff}, []byte{0x02})
+	require.Equal(t, []common.Hash{{1}, {0xff}}, BloomBitHeadsForSection(db, 2, 1))
+	require.Empty(t, BloomBitHeadsForSection(db, 5, 0))
+
+	dst := NewMemoryDatabase(log.Global)
+	copied, err := CopyBloomBits(db, dst, 7, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, 2, copied)
+	require.Equal(t, []uint{7}, PopulatedBloomBits(dst))
+	bits, err := ReadBloomBits(dst, 7, 2, common.Hash{2})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01}, bits)
+}
+
+func TestSnapshotTxLookupRange(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	for i, txs := range []types.Transactions{{tx1, tx2}, {tx3}} {
+		block := createBlockWithTransactions(txs)
+		block.SetNumber(big.NewInt(int64(i+1)), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), uint64(i+1))
+		WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+	}
+
+	var buf bytes.Buffer
+	count, err := SnapshotTxLookupRange(db, 1, 1, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+
+	restored := NewMemoryDatabase(log.Global)
+	count, err = RestoreTxLookupRange(restored, &buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+	for _, tx := range []*types.Transaction{tx1, tx2} {
+		entry := ReadTxLookupEntry(restored, tx.Hash())
+		require.NotNil(t, entry, "Restored lookup entry missing")
+		require.Equal(t, uint64(1), *entry)
+	}
+	require.Nil(t, ReadTxLookupEntry(restored, tx3.Hash()), "Out of range lookup entry restored")
+}
+
+func TestOversizedTxLookupEntry(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+
+	// The largest legitimate legacy entry must still decode
+	entry, err := proto.Marshal(&ProtoLegacyTxLookupEntry{
+		BlockIndex: ^uint64(0),
+		Index:      ^uint64(0),
+		Hash:       &common.ProtoHash{Value: common.Hash{0xff}.Bytes()},
+	})
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(entry), maxLegacyTxLookupEntryLength)
+	writeTxLookupEntry(db, common.Hash{1}, entry)
+	number := ReadTxLookupEntry(db, common.Hash{1})
+	require.NotNil(t, number, "Legacy lookup entry rejected")
+	require.Equal(t, ^uint64(0), *number)
+
+	writeTxLookupEntry(db, common.Hash{2}, make([]byte, maxLegacyTxLookupEntryLength+1))
+	require.Nil(t, ReadTxLookupEntry(db, common.Hash{2}), "Oversized lookup entry decoded")
+}
+
+func TestTxLookupTTL(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	expiring, permanent := createTransaction(1), createTransaction(2)
+
+	block := createBlockWithTransactions(types.Transactions{expiring})
+	block.SetNumber(big.NewInt(5), common.ZONE_CTX)
+	WriteTxLookupEntriesByBlockTTL(db, block, common.ZONE_CTX, 10)
+	WriteTxLookupEntries(db, 6, []common.Hash{permanent.Hash()})
+
+	entry := ReadTxLookupEntry(db, expiring.Hash())
+	require.NotNil(t, entry, "TTL lookup entry not found")
+	require.Equal(t, uint64(5), *entry)
+
+	swept, err := SweepExpiredTxLookups(db, 10)
+	require.NoError(t, err)
+	require.Equal(t, 0, swept, "Entry swept before its retention ended")
+
+	swept, err = SweepExpiredTxLookups(db, 11)
+	require.NoError(t, err)
+	require.Equal(t, 1, swept)
+	require.Nil(t, ReadTxLookupEntry(db, expiring.Hash()), "Expired lookup entry not swept")
+	require.NotNil(t, ReadTxLookupEntry(db, permanent.Hash()), "Lookup entry without TTL swept")
+}
+
+func TestEntropyQuantiles(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	for n, diff := range []int64{4000, 1000, 3000, 2000, 5000} {
+		block := createBlockWithTransactions(types.Transactions{createTransaction(uint64(n))})
+		block.SetNumber(big.NewInt(int64(n)), common.ZONE_CTX)
+		block.WorkObjectHeader().SetDifficulty(big.NewInt(diff))
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), uint64(n))
+	}
+
+	quantiles, err := EntropyQuantiles(db, 0, 4, []float64{0, 0.5, 1})
+	require.NoError(t, err)
+	require.Equal(t, []*big.Int{big.NewInt(1000), big.NewInt(3000), big.NewInt(5000)}, quantiles)
+
+	// Difficulties of 2^10 and 2^12 have entropies of 10 and 12 bits
+	for n, diff := range []int64{1 << 10, 1 << 12} {
+		block := createBlockWithTransactions(types.Transactions{createTransaction(uint64(10 + n))})
+		block.SetNumber(big.NewInt(int64(10+n)), common.ZONE_CTX)
+		block.WorkObjectHeader().SetDifficulty(big.NewInt(diff))
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), uint64(10+n))
+	}
+	mean, stddev, err := EntropyMeanStdDev(db, 10, 11)
+	require.NoError(t, err)
+	require.Zero(t, mean.Cmp(new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(11), common.MantBits))))
+	require.Zero(t, stddev.Cmp(new(big.Float).SetInt(common.Big2e64)))
+	_, _, err = EntropyMeanStdDev(db, 20, 30)
+	require.Error(t, err, "Empty range accepted")
+
+	_, err = EntropyQuantiles(db, 20, 30, []float64{0.5})
+	require.Error(t, err, "Empty range accepted")
+	_, err = EntropyQuantiles(db, 0, 4, []float64{1.5})
+	require.Error(t, err, "Out of range quantile accepted")
+}
+
+func TestRepairTxLookupGaps(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	intact, missing := createTransaction(1), createTransaction(2)
+
+	block := createBlockWithTransactions(types.Transactions{intact, missing})
+	block.SetNumber(big.NewInt(3), common.ZONE_CTX)
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+	WriteCanonicalHash(db, block.Hash(), 3)
+	// Point the intact entry elsewhere to verify it is not rewritten.
+	WriteTxLookupEntries(db, 7, []common.Hash{intact.Hash()})
+
+	repaired, err := RepairTxLookupGaps(db, 0, 5, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, repaired)
+	require.Equal(t, uint64(3), *ReadTxLookupEntry(db, missing.Hash()))
+	require.Equal(t, uint64(7), *ReadTxLookupEntry(db, intact.Hash()), "Existing lookup entry rewritten")
+
+	interrupt := make(chan struct{})
+	close(interrupt)
+	DeleteTxLookupEntry(db, missing.Hash())
+	repaired, err = RepairTxLookupGaps(db, 0, 5, interrupt)
+	require.NoError(t, err)
+	require.Equal(t, 0, repaired, "Interrupted repair wrote entries")
+}
+
+func TestReadTransactionsByType(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := createBlockWithTransactions(types.Transactions{tx1, tx2})
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+
+	quaiTxs := ReadTransactionsByType(db, block.NumberU64(common.ZONE_CTX), block.Hash(), types.QuaiTxType)
+	require.Len(t, quaiTxs, 2)
+	require.Equal(t, tx1.Hash(), quaiTxs[0].Hash())
+	require.Equal(t, tx2.Hash(), quaiTxs[1].Hash())
+
+	qiTxs := ReadTransactionsByType(db, block.NumberU64(common.ZONE_CTX), block.Hash(), types.QiTxType)
+	require.NotNil(t, qiTxs)
+	require.Empty(t, qiTxs)
+	require.NotNil(t, ReadTransactionsByType(db, 0, common.Hash{1}, types.QuaiTxType), "Missing body returned nil")
+}
+
+func TestFindDuplicateTransactions(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	for i, txs := range []types.Transactions{{tx1, tx2}, {tx3}, {tx1}} {
+		block := createBlockWithTransactions(txs)
+		block.SetNumber(big.NewInt(int64(i+1)), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), uint64(i+1))
+	}
+
+	duplicates, err := FindDuplicateTransactions(db, 0, 5)
+	require.NoError(t, err)
+	require.Equal(t, map[common.Hash][]uint64{tx1.Hash(): {1, 3}}, duplicates)
+
+	duplicates, err = FindDuplicateTransactions(db, 1, 2)
+	require.NoError(t, err)
+	require.Empty(t, duplicates)
+
+	_, err = FindDuplicateTransactions(db, 2, 1)
+	require.Error(t, err)
+}
+
+func TestBloomBitsAuto(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	sparse := make([]byte, 512)
+	sparse[100] = 0x10
+	dense := bytes.Repeat([]byte{0xa5}, 512)
+
+	WriteBloomBitsAuto(db, 1, 0, common.Hash{1}, sparse)
+	WriteBloomBitsAuto(db, 2, 0, common.Hash{1}, dense)
+	// Blobs written by WriteBloomBits must decode as well
+	WriteBloomBits(db, 3, 0, common.Hash{1}, bitutil.CompressBytes(sparse))
+	WriteBloomBits(db, 4, 0, common.Hash{1}, bitutil.CompressBytes(dense))
+
+	// Incompressible vectors are stored verbatim, in a form the bloom bits
+	// matcher decompresses directly
+	stored, _ := ReadBloomBits(db, 2, 0, common.Hash{1})
+	require.Equal(t, dense, stored, "Incompressible vector not stored raw")
+	decompressed, err := bitutil.DecompressBytes(stored, len(dense))
+	require.NoError(t, err)
+	require.Equal(t, dense, decompressed)
+
+	for bit, want := range map[uint][]byte{1: sparse, 2: dense, 3: sparse, 4: dense} {
+		have, err := ReadBloomBitsAuto(db, bit, 0, common.Hash{1}, 512)
+		require.NoError(t, err)
+		require.Equal(t, want, have, "bit %d", bit)
+	}
+}
+
+func TestSectionsWithBitSet(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	head := common.Hash{0xaa}
+	set, empty := make([]byte, params.BloomBitsBlocks/8), make([]byte, params.BloomBitsBlocks/8)
+	set[7] = 0x80
+
+	WriteBloomBits(db, 3, 0, head, bitutil.CompressBytes(set))
+	WriteBloomBits(db, 3, 1, head, bitutil.CompressBytes(empty))
+	WriteBloomBits(db, 3, 2, head, bitutil.CompressBytes(set))
+	WriteBloomBits(db, 3, 3, common.Hash{0xbb}, bitutil.CompressBytes(set))
+	WriteBloomBits(db, 3, 4, head, bitutil.CompressBytes(set))
+
+	sections, err := SectionsWithBitSet(db, 3, 0, 4, head)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, sections)
+
+	corrupt, err := VerifyBloomBitsDecompression(db, 3, 0, 5, head, params.BloomBitsBlocks)
+	require.NoError(t, err)
+	require.Empty(t, corrupt)
+
+	WriteBloomBits(db, 3, 1, head, make([]byte, params.BloomBitsBlocks/8+1))
+	_, err = SectionsWithBitSet(db, 3, 0, 4, head)
+	require.Error(t, err, "Vector of a foreign section size decompressed")
+
+	corrupt, err = VerifyBloomBitsDecompression(db, 3, 0, 5, head, params.BloomBitsBlocks)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1}, corrupt)
+}
+
+func TestTxLookupCoverageGaps(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	// Blocks 1, 3 and 4 are unindexed, 2 is indexed, 5 is empty, 6 is unindexed
+	// and 7 is missing.
+	for number := uint64(1); number <= 6; number++ {
+		var txs types.Transactions
+		if number != 5 {
+			txs = types.Transactions{createTransaction(number)}
+		}
+		block := createBlockWithTransactions(txs)
+		block.SetNumber(new(big.Int).SetUint64(number), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), number)
+		if number == 2 {
+			WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+		}
+	}
+
+	gaps, err := TxLookupCoverageGaps(db, 1, 6)
+	require.NoError(t, err)
+	require.Equal(t, [][2]uint64{{1, 1}, {3, 4}, {6, 6}}, gaps)
+
+	gaps, err = TxLookupCoverageGaps(db, 3, 7)
+	require.Error(t, err, "Missing block not reported")
+	require.Equal(t, [][2]uint64{{3, 4}, {6, 6}}, gaps)
+}
+
+// createQiTransaction creates a Qi transaction spending a single outpoint, which
+// unlike Quai transactions has no recipient, value or nonce.
+func createQiTransaction(t *testing.T) *types.Transaction {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	txHash := common.Hash{1}
+	return types.NewTx(&types.QiTx{
+		ChainID: big.NewInt(1),
+		TxIn:    types.TxIns{*types.NewTxIn(types.NewOutPoint(&txHash, 0), crypto.FromECDSAPub(&key.PublicKey), nil)},
+		TxOut:   types.TxOuts{*types.NewTxOut(1, []byte{0x02}, big.NewInt(0))},
+	})
+}
+
+func TestReadBlockTransactionsForAddress(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	// The Qi transaction in the middle must be skipped rather than panic
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := createBlockWithTransactions(types.Transactions{tx1, createQiTransaction(t), tx2})
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+	signer := types.NewSigner(big.NewInt(1), common.Location{0, 0})
+
+	recipient := common.BytesToAddress([]byte{0x01}, common.Location{0, 0})
+	txs := ReadBlockTransactionsForAddress(db, block.NumberU64(common.ZONE_CTX), block.Hash(), recipient, signer)
+	require.Len(t, txs, 2)
+	require.Equal(t, tx1.Hash(), txs[0].Hash())
+
+	other := common.BytesToAddress([]byte{0x02}, common.Location{0, 0})
+	txs = ReadBlockTransactionsForAddress(db, block.NumberU64(common.ZONE_CTX), block.Hash(), other, signer)
+	require.NotNil(t, txs)
+	require.Empty(t, txs)
+}
+
+func TestDeleteBloombitsLimited(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	for section := uint64(0); section < 5; section++ {
+		WriteBloomBits(db, 4, section, common.Hash{1}, []byte{0x01})
+	}
+	WriteBloomBits(db, 4, 1, common.Hash{2}, []byte{0x01})
+
+	deleted, next, done := DeleteBloombitsLimited(db, 4, 0, 4, 2)
+	require.Equal(t, 2, deleted)
+	require.Equal(t, uint64(1), next)
+	require.False(t, done)
+
+	deleted, next, done = DeleteBloombitsLimited(db, 4, next, 4, 2)
+	require.Equal(t, 2, deleted)
+	require.Equal(t, uint64(3), next)
+	require.False(t, done)
+
+	deleted, next, done = DeleteBloombitsLimited(db, 4, next, 4, 2)
+	require.Equal(t, 1, deleted)
+	require.Equal(t, uint64(4), next)
+	require.True(t, done)
+	require.Equal(t, []common.Hash{{1}}, BloomBitHeadsForSection(db, 4, 4), "Section outside the range deleted")
+}
+
+func TestTxLookupEntriesSince(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	_, ok := ReadTxIndexHighWater(db)
+	require.False(t, ok, "High water mark of an empty index returned")
+
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	for i, txs := range []types.Transactions{{tx1}, {tx2, tx3}} {
+		block := createBlockWithTransactions(txs)
+		block.SetNumber(big.NewInt(int64(i+1)), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), uint64(i+1))
+		WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+		WriteTxIndexHighWater(db, db, block.NumberU64(common.ZONE_CTX))
+	}
+	highWater, ok := ReadTxIndexHighWater(db)
+	require.True(t, ok)
+	require.Equal(t, uint64(2), highWater)
+
+	// The mark is never lowered, even when written through a batch which can
+	// not be read, as happens for a side chain block after a higher one
+	batch := db.NewBatch()
+	WriteTxIndexHighWater(db, batch, 1)
+	require.NoError(t, batch.Write())
+	highWater, _ = ReadTxIndexHighWater(db)
+	require.Equal(t, uint64(2), highWater, "High water mark lowered")
+
+	batch = db.NewBatch()
+	WriteTxIndexHighWater(db, batch, 5)
+	require.NoError(t, batch.Write())
+	highWater, _ = ReadTxIndexHighWater(db)
+	require.Equal(t, uint64(5), highWater, "High water mark not raised")
+
+	entries, err := TxLookupEntriesSince(db, 1, 2)
+	require.NoError(t, err)
+	require.Equal(t, map[common.Hash]uint64{tx2.Hash(): 2, tx3.Hash(): 2}, entries)
+
+	_, err = TxLookupEntriesSince(db, 1, 3)
+	require.Error(t, err, "Missing block not reported")
+}
+
+func TestReadTransactionsByStatus(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := createBlockWithTransactions(types.Transactions{tx1, tx2})
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+
+	succeeded, failed := ReadTransactionsByStatus(db, 0, block.Hash())
+	require.NotNil(t, succeeded)
+	require.NotNil(t, failed)
+	require.Empty(t, append(succeeded, failed...), "Transactions without receipts partitioned")
+
+	receipts := createReceipts(types.Transactions{tx1, tx2})
+	receipts[0].Status = types.ReceiptStatusFailed
+	WriteReceipts(db, block.Hash(), 0, receipts)
+
+	succeeded, failed = ReadTransactionsByStatus(db, 0, block.Hash())
+	require.Len(t, succeeded, 1)
+	require.Equal(t, tx2.Hash(), succeeded[0].Hash())
+	require.Len(t, failed, 1)
+	require.Equal(t, tx1.Hash(), failed[0].Hash())
+}
+
+func TestRecomputeBloomBitsForSection(t *testing.T) {
+	const sectionSize = 16
+	db := NewMemoryDatabase(log.Global)
+	head := common.Hash{0xbb}
+
+	// Index section 1 the way the bloom indexer does, from the block blooms
+	gen, err := bloombits.NewGenerator(sectionSize)
+	require.NoError(t, err)
+	var hashes []common.Hash
+	for i := uint64(0); i < sectionSize; i++ {
+		number := sectionSize + i
+		block := createBlockWithTransactions(types.Transactions{createTransaction(number)})
+		block.SetNumber(new(big.Int).SetUint64(number), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), number)
+		var bloom types.Bloom
+		bloom.Add(new(big.Int).SetUint64(number).Bytes())
+		WriteBloom(db, block.Hash(), bloom)
+		require.NoError(t, gen.AddBloom(uint(i), bloom))
+		hashes = append(hashes, block.Hash())
+	}
+	for i := 0; i < types.BloomBitLength; i++ {
+		bits, err := gen.Bitset(uint(i))
+		require.NoError(t, err)
+		WriteBloomBits(db, uint(i), 1, head, bitutil.CompressBytes(bits))
+	}
+	want := make([][]byte, types.BloomBitLength)
+	for i := range want {
+		want[i], _ = ReadBloomBits(db, uint(i), 1, head)
+	}
+	// Corrupt a vector and repair the section
+	WriteBloomBits(db, 7, 1, head, []byte{0xff})
+	require.NoError(t, RecomputeBloomBitsForSection(db, 1, head, sectionSize, params.TestChainConfig))
+	for i := range want {
+		have, err := ReadBloomBits(db, uint(i), 1, head)
+		require.NoError(t, err)
+		require.Equal(t, want[i], have, "bit %d", i)
+	}
+
+	// A block with transactions but neither a bloom nor receipts must not be
+	// indexed as empty
+	DeleteBloom(db, hashes[3], sectionSize+3)
+	WriteBloomBits(db, 7, 1, head, []byte{0xff})
+	require.Error(t, RecomputeBloomBitsForSection(db, 1, head, sectionSize, params.TestChainConfig))
+	have, _ := ReadBloomBits(db, 7, 1, head)
+	require.Equal(t, []byte{0xff}, have, "Bloom bits written for an incomplete section")
+
+	// A missing canonical block fails the same way
+	require.Error(t, RecomputeBloomBitsForSection(db, 2, head, sectionSize, params.TestChainConfig))
+}
+
+func TestReadBloomBitsRange(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	head := common.Hash{0xaa}
+	WriteBloomBits(db, 3, 4, head, []byte{0x01})
+	WriteBloomBits(db, 3, 6, head, []byte{0x02})
+	WriteBloomBits(db, 3, 5, common.Hash{0xbb}, []byte{0x03})
+	WriteBloomBits(db, 4, 5, head, []byte{0x04})
+	WriteBloomBits(db, 3, 7, head, []byte{0x05})
+
+	bits, err := ReadBloomBitsRange(db, 3, 4, 7, head)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0x01}, nil, {0x02}}, bits)
+
+	bits, err = ReadBloomBitsRange(db, 3, 5, 5, head)
+	require.NoError(t, err)
+	require.Empty(t, bits)
+
+	_, err = ReadBloomBitsRange(db, 3, 7, 4, head)
+	require.Error(t, err, "Inverted range accepted")
+	_, err = ReadBloomBitsRange(db, 3, 0, math.MaxUint64, head)
+	require.Error(t, err, "Unbounded range accepted")
+}
+
+func TestReadBloomBitsWithFallback(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	current, parent, grandparent := common.Hash{3}, common.Hash{2}, common.Hash{1}
+	WriteBloomBits(db, 5, 1, parent, []byte{0x01})
+	WriteBloomBits(db, 5, 1, grandparent, []byte{0x02})
+
+	bits, head, err := ReadBloomBitsWithFallback(db, 5, 1, []common.Hash{current, parent, grandparent})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01}, bits)
+	require.Equal(t, parent, head, "Bits not read from the first head holding them")
+
+	_, _, err = ReadBloomBitsWithFallback(db, 5, 2, []common.Hash{current, parent, grandparent})
+	require.Error(t, err, "Missing section returned bits")
+	_, _, err = ReadBloomBitsWithFallback(db, 5, 1, nil)
+	require.Error(t, err, "Bits returned without heads")
+}
+
+// createSignedTransaction creates a Quai transaction signed by key, so that its
+// sender can be recovered with the test signer.
+func createSignedTransaction(t *testing.T, key *ecdsa.PrivateKey, nonce uint64, value int64) *types.Transaction {
+	to := common.BytesToAddress([]byte{0x11}, common.Location{0, 0})
+	tx, err := types.SignNewTx(key, types.NewSigner(big.NewInt(1), common.Location{0, 0}), &types.QuaiTx{
+		ChainID:    big.NewInt(1),
+		Nonce:      nonce,
+		MinerTip:   big.NewInt(0),
+		GasPrice:   big.NewInt(0),
+		To:         &to,
+		Value:      big.NewInt(value),
+		AccessList: types.AccessList{},
+	})
+	require.NoError(t, err)
+	return tx
+}
+
+func TestReadBlockSenders(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	signer := types.NewSigner(big.NewInt(1), common.Location{0, 0})
+	key1, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	key2, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	sender1 := crypto.PubkeyToAddress(key1.PublicKey, common.Location{0, 0})
+	sender2 := crypto.PubkeyToAddress(key2.PublicKey, common.Location{0, 0})
+
+	senders := ReadBlockSenders(db, 0, common.Hash{1}, signer)
+	require.NotNil(t, senders)
+	require.Empty(t, senders, "Missing block returned senders")
+
+	// The unsigned transaction is skipped and the repeated sender deduplicated
+	block := createBlockWithTransactions(types.Transactions{
+		createSignedTransaction(t, key2, 0, 1),
+		createTransaction(1),
+		createSignedTransaction(t, key1, 0, 1),
+		createSignedTransaction(t, key2, 1, 1),
+	})
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+
+	senders = ReadBlockSenders(db, block.NumberU64(common.ZONE_CTX), block.Hash(), signer)
+	require.Equal(t, []common.Address{sender2, sender1}, senders)
+}
+
+func TestReadTransactionCumulativeGas(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := createBlockWithTransactions(types.Transactions{tx1, tx2})
+	block.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+	WriteCanonicalHash(db, block.Hash(), block.NumberU64(common.ZONE_CTX))
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	if _, _, ok := ReadTransactionCumulativeGas(db, tx1.Hash()); ok {
+		t.Fatalf("Cumulative gas returned without receipts")
+	}
+	if _, _, ok := ReadTransactionCumulativeGas(db, common.Hash{0xff}); ok {
+		t.Fatalf("Cumulative gas returned for unknown transaction")
+	}
+
+	receipts := createReceipts(types.Transactions{tx1, tx2})
+	receipts[1].CumulativeGasUsed = 110000
+	WriteReceipts(db, block.Hash(), block.NumberU64(common.ZONE_CTX), receipts)
+
+	cumulative, total, ok := ReadTransactionCumulativeGas(db, tx1.Hash())
+	require.True(t, ok)
+	require.Equal(t, uint64(55000), cumulative)
+	require.Equal(t, uint64(110000), total)
+
+	cumulative, total, ok = ReadTransactionCumulativeGas(db, tx2.Hash())
+	require.True(t, ok)
+	require.Equal(t, uint64(110000), cumulative)
+	require.Equal(t, uint64(110000), total)
+
+	// Receipts not matching the body are rejected
+	WriteReceipts(db, block.Hash(), block.NumberU64(common.ZONE_CTX), receipts[:1])
+	if _, _, ok := ReadTransactionCumulativeGas(db, tx1.Hash()); ok {
+		t.Fatalf("Cumulative gas returned for mismatched receipts")
+	}
+}
+
+func TestReadTransactionPositionPercentile(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	txs := types.Transactions{createTransaction(1), createTransaction(2), createTransaction(3)}
+	block := createBlockWithTransactions(txs)
+	block.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	single := createBlockWithTransactions(types.Transactions{createTransaction(4)})
+	single.SetNumber(big.NewInt(2), common.ZONE_CTX)
+	for _, wo := range []*types.WorkObject{block, single} {
+		WriteWorkObject(db, wo.Hash(), wo, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, wo.Hash(), wo.NumberU64(common.ZONE_CTX))
+		WriteTxLookupEntriesByBlock(db, wo, common.ZONE_CTX)
+	}
+
+	for i, want := range []float64{0, 0.5, 1} {
+		tx, percentile, ok := ReadTransactionPositionPercentile(db, txs[i].Hash())
+		require.True(t, ok)
+		require.Equal(t, txs[i].Hash(), tx.Hash())
+		require.Equal(t, want, percentile)
+	}
+
+	// The percentile of the only transaction of a block is undefined
+	singleTx := single.Body().Transactions()[0]
+	tx, percentile, ok := ReadTransactionPositionPercentile(db, singleTx.Hash())
+	require.False(t, ok)
+	require.Equal(t, singleTx.Hash(), tx.Hash())
+	require.Zero(t, percentile)
+
+	tx, _, ok = ReadTransactionPositionPercentile(db, common.Hash{0xff})
+	require.False(t, ok)
+	require.Nil(t, tx, "Unknown transaction returned")
+}
+
+func TestReadBlockTotalValue(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	total, ok := ReadBlockTotalValue(db, 0, common.Hash{1})
+	require.False(t, ok)
+	require.Zero(t, total.Sign(), "Missing block returned a value")
+
+	// The Qi transaction carries no value and must be skipped
+	block := createBlockWithTransactions(types.Transactions{
+		createSignedTransaction(t, key, 0, 3),
+		createQiTransaction(t),
+		createSignedTransaction(t, key, 1, 4),
+	})
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+
+	total, ok = ReadBlockTotalValue(db, block.NumberU64(common.ZONE_CTX), block.Hash())
+	require.True(t, ok)
+	require.Equal(t, big.NewInt(7), total)
+}
+
+func TestFirstBlockWithSender(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	signer := types.NewSigner(big.NewInt(1), common.Location{0, 0})
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	other, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	sender := crypto.PubkeyToAddress(key.PublicKey, common.Location{0, 0})
+
+	// Block 2 is missing and must be skipped, the sender first appears in 3
+	blocks := map[uint64]*types.Transaction{
+		1: createSignedTransaction(t, other, 0, 1),
+		3: createSignedTransaction(t, key, 0, 1),
+		4: createSignedTransaction(t, key, 1, 1),
+	}
+	for number, tx := range blocks {
+		block := createBlockWithTransactions(types.Transactions{tx})
+		block.SetNumber(new(big.Int).SetUint64(number), common.ZONE_CTX)
+		WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+		WriteCanonicalHash(db, block.Hash(), number)
+	}
+
+	number, ok := FirstBlockWithSender(db, sender, 1, 4, signer)
+	require.True(t, ok)
+	require.Equal(t, uint64(3), number)
+
+	number, ok = FirstBlockWithSender(db, sender, 4, 4, signer)
+	require.True(t, ok)
+	require.Equal(t, uint64(4), number)
+
+	_, ok = FirstBlockWithSender(db, sender, 1, 2, signer)
+	require.False(t, ok, "Sender found outside its blocks")
+}
+
+// writeCanonicalBlock stores a block holding txs as the canonical block at the
+// given number.
+func writeCanonicalBlock(db ethdb.Database, number uint64, txs types.Transactions) *types.WorkObject {
+	block := createBlockWithTransactions(txs)
+	block.SetNumber(new(big.Int).SetUint64(number), common.ZONE_CTX)
+	WriteWorkObject(db, block.Hash(), block, types.BlockObject, common.ZONE_CTX)
+	WriteCanonicalHash(db, block.Hash(), number)
+	return block
+}
+
+func TestIsBlockFullyIndexed(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+
+	indexed, missing := IsBlockFullyIndexed(db, 1, common.Hash{0xff})
+	require.False(t, indexed, "Missing block reported as indexed")
+	require.Empty(t, missing)
+
+	WriteTxLookupEntries(db, 1, []common.Hash{tx1.Hash()})
+	indexed, missing = IsBlockFullyIndexed(db, 1, block.Hash())
+	require.False(t, indexed)
+	require.Equal(t, []common.Hash{tx2.Hash()}, missing)
+
+	WriteTxLookupEntries(db, 1, []common.Hash{tx2.Hash()})
+	indexed, missing = IsBlockFullyIndexed(db, 1, block.Hash())
+	require.True(t, indexed)
+	require.Empty(t, missing)
+}
+
+func TestRekeyBloomBits(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	oldHead, newHead := common.Hash{0xaa}, common.Hash{0xbb}
+	for _, bit := range []uint{3, 7} {
+		for section := uint64(0); section < 3; section++ {
+			WriteBloomBits(db, bit, section, oldHead, []byte{byte(bit), byte(section)})
+		}
+	}
+
+	moved, err := RekeyBloomBits(db, oldHead, oldHead, 0, 3)
+	require.NoError(t, err)
+	require.Zero(t, moved, "Vectors moved onto their own head")
+
+	moved, err = RekeyBloomBits(db, oldHead, newHead, 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, 4, moved)
+	for _, bit := range []uint{3, 7} {
+		for section := uint64(0); section < 2; section++ {
+			bits, err := ReadBloomBits(db, bit, section, newHead)
+			require.NoError(t, err)
+			require.Equal(t, []byte{byte(bit), byte(section)}, bits)
+			_, err = ReadBloomBits(db, bit, section, oldHead)
+			require.Error(t, err, "Moved vector left under the old head")
+		}
+		// The section outside the range stays under the old head
+		_, err := ReadBloomBits(db, bit, 2, oldHead)
+		require.NoError(t, err)
+		_, err = ReadBloomBits(db, bit, 2, newHead)
+		require.Error(t, err, "Vector outside the range moved")
+	}
+}
+
+func TestCountTransactionsInRange(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	writeCanonicalBlock(db, 1, types.Transactions{createTransaction(1), createTransaction(2)})
+	writeCanonicalBlock(db, 2, types.Transactions{})
+	writeCanonicalBlock(db, 3, types.Transactions{createTransaction(3)})
+
+	count, err := CountTransactionsInRange(db, 1, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+
+	// The count up to the missing block is returned alongside the error
+	count, err = CountTransactionsInRange(db, 1, 5)
+	require.Error(t, err, "Missing block not reported")
+	require.Equal(t, uint64(3), count)
+}
+
+func TestStreamTransactions(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+	writeCanonicalBlock(db, 3, types.Transactions{tx3})
+
+	type position struct {
+		hash          common.Hash
+		number, index uint64
+	}
+	// The missing block 2 is skipped
+	var seen []position
+	err := StreamTransactions(db, 1, 3, func(tx *types.Transaction, number, index uint64) bool {
+		seen = append(seen, position{tx.Hash(), number, index})
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []position{{tx1.Hash(), 1, 0}, {tx2.Hash(), 1, 1}, {tx3.Hash(), 3, 0}}, seen)
+
+	seen = nil
+	err = StreamTransactions(db, 1, 3, func(tx *types.Transaction, number, index uint64) bool {
+		seen = append(seen, position{tx.Hash(), number, index})
+		return len(seen) < 2
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, 2, "Iteration not stopped early")
+
+	err = StreamTransactions(db, 3, 1, func(*types.Transaction, uint64, uint64) bool { return true })
+	require.Error(t, err, "Inverted range accepted")
+}
+
+func TestReplaceTxLookupEntriesForBlock(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	dropped, kept, added := createTransaction(1), createTransaction(2), createTransaction(3)
+	oldBlock := createBlockWithTransactions(types.Transactions{dropped, kept})
+	oldBlock.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	newBlock := createBlockWithTransactions(types.Transactions{kept, added})
+	newBlock.SetNumber(big.NewInt(2), common.ZONE_CTX)
+	WriteTxLookupEntriesByBlock(db, oldBlock, common.ZONE_CTX)
+
+	// Nothing changes until the caller flushes the batch
+	batch := db.NewBatch()
+	ReplaceTxLookupEntriesForBlock(batch, oldBlock, newBlock, common.ZONE_CTX)
+	require.True(t, HasTxLookupEntry(db, dropped.Hash()))
+	require.False(t, HasTxLookupEntry(db, added.Hash()))
+
+	require.NoError(t, batch.Write())
+	require.False(t, HasTxLookupEntry(db, dropped.Hash()), "Dropped lookup returned")
+	for _, tx := range []*types.Transaction{kept, added} {
+		entry := ReadTxLookupEntry(db, tx.Hash())
+		require.NotNil(t, entry)
+		require.Equal(t, uint64(2), *entry)
+	}
+}
+
+func TestReadTransactionAndReceipt(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	tx, receipt, _, _, _ := ReadTransactionAndReceipt(db, tx2.Hash(), params.TestChainConfig)
+	require.Nil(t, tx, "Transaction returned without receipts")
+	require.Nil(t, receipt, "Receipt returned without receipts")
+
+	WriteReceipts(db, block.Hash(), 1, createReceipts(types.Transactions{tx1, tx2}))
+
+	tx, receipt, blockHash, number, index := ReadTransactionAndReceipt(db, tx2.Hash(), params.TestChainConfig)
+	require.Equal(t, tx2.Hash(), tx.Hash())
+	require.Equal(t, tx2.Hash(), receipt.TxHash)
+	require.Equal(t, block.Hash(), receipt.BlockHash, "Receipt fields not derived")
+	require.Equal(t, uint(1), receipt.TransactionIndex)
+	require.Equal(t, block.Hash(), blockHash)
+	require.Equal(t, uint64(1), number)
+	require.Equal(t, uint64(1), index)
+
+	tx, receipt, _, _, _ = ReadTransactionAndReceipt(db, common.Hash{0xff}, params.TestChainConfig)
+	require.Nil(t, tx, "Unknown transaction returned")
+	require.Nil(t, receipt, "Unknown receipt returned")
+}
+
+func TestStreamTxLookupByBlockOrder(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	writeCanonicalBlock(db, 1, types.Transactions{tx1})
+	writeCanonicalBlock(db, 3, types.Transactions{tx2, tx3})
+
+	type entry struct {
+		hash   common.Hash
+		number uint64
+	}
+	// The missing block 2 is skipped
+	var seen []entry
+	err := StreamTxLookupByBlockOrder(db, 1, 3, func(hash common.Hash, number uint64) bool {
+		seen = append(seen, entry{hash, number})
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []entry{{tx1.Hash(), 1}, {tx2.Hash(), 3}, {tx3.Hash(), 3}}, seen)
+
+	seen = nil
+	err = StreamTxLookupByBlockOrder(db, 1, 3, func(hash common.Hash, number uint64) bool {
+		seen = append(seen, entry{hash, number})
+		return false
+	})
+	require.NoError(t, err)
+	require.Len(t, seen, 1, "Iteration not stopped early")
+
+	err = StreamTxLookupByBlockOrder(db, 3, 1, func(common.Hash, uint64) bool { return true })
+	require.Error(t, err, "Inverted range accepted")
+}
+
+func TestBlockNumberForLogIndex(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	logs := func(n int) []*types.Log {
+		out := make([]*types.Log, n)
+		for i := range out {
+			out[i] = &types.Log{Address: common.BytesToAddress([]byte{byte(i + 1)}, common.Location{0, 0})}
+		}
+		return out
+	}
+	// Block 1 holds logs 0 and 1, block 2 has no transactions and so no
+	// receipts, and block 3 holds logs 2 and 3
+	for number, counts := range map[uint64][]int{1: {2, 0}, 3: {1, 1}} {
+		txs := types.Transactions{createTransaction(number * 2), createTransaction(number*2 + 1)}
+		block := writeCanonicalBlock(db, number, txs)
+		receipts := createReceipts(txs)
+		for i, count := range counts {
+			receipts[i].Logs = logs(count)
+		}
+		WriteReceipts(db, block.Hash(), number, receipts)
+	}
+	writeCanonicalBlock(db, 2, types.Transactions{})
+
+	for index, want := range [][2]uint64{{1, 0}, {1, 1}, {3, 0}, {3, 1}} {
+		number, offset, err := BlockNumberForLogIndex(db, uint64(index), 1, 3)
+		require.NoError(t, err)
+		require.Equal(t, want, [2]uint64{number, offset}, "Wrong position of log %d", index)
+	}
+	_, _, err := BlockNumberForLogIndex(db, 4, 1, 3)
+	require.Error(t, err, "Log beyond the range located")
+	_, _, err = BlockNumberForLogIndex(db, 4, 1, 4)
+	require.Error(t, err, "Missing block not reported")
+
+	// A block with transactions but no receipts must not be counted as empty,
+	// as that would shift every later log index
+	writeCanonicalBlock(db, 2, types.Transactions{createTransaction(10)})
+	_, _, err = BlockNumberForLogIndex(db, 2, 1, 3)
+	require.Error(t, err, "Missing receipts not reported")
+}
+
+func TestOnReorgInvalidateTxs(t *testing.T) {
+	kept, moved, dropped, added := createTransaction(1), createTransaction(2), createTransaction(3), createTransaction(4)
+	oldBlock := createBlockWithTransactions(types.Transactions{kept, moved, dropped})
+	oldBlock.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	// The replacement at the same height keeps the first transaction at the
+	// same index, which is still stale as its block hash changed
+	newBlock := createBlockWithTransactions(types.Transactions{kept, added, moved})
+	newBlock.SetNumber(big.NewInt(1), common.ZONE_CTX)
+	newBlock.SetParentHash(common.Hash{0x01}, common.ZONE_CTX)
+	require.NotEqual(t, oldBlock.Hash(), newBlock.Hash())
+
+	invalidated := func(oldWo, newWo *types.WorkObject) map[common.Hash]int {
+		seen := make(map[common.Hash]int)
+		OnReorgInvalidateTxs(oldWo, newWo, common.ZONE_CTX, func(hash common.Hash) { seen[hash]++ })
+		return seen
+	}
+	require.Equal(t, map[common.Hash]int{
+		kept.Hash():    1,
+		moved.Hash():   1,
+		dropped.Hash(): 1,
+		added.Hash():   1,
+	}, invalidated(oldBlock, newBlock))
+
+	require.Empty(t, invalidated(oldBlock, oldBlock), "Unchanged block invalidated")
+	require.Equal(t, map[common.Hash]int{kept.Hash(): 1, added.Hash(): 1, moved.Hash(): 1}, invalidated(nil, newBlock))
+	require.Equal(t, map[common.Hash]int{kept.Hash(): 1, moved.Hash(): 1, dropped.Hash(): 1}, invalidated(oldBlock, nil))
+}
+
+func TestReadTransactionPosition(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	v6tx, v4tx := createTransaction(1), createTransaction(2)
+	writeCanonicalBlock(db, 1, types.Transactions{createTransaction(3), v6tx})
+	v4block := writeCanonicalBlock(db, 2, types.Transactions{v4tx})
+
+	// The v3 entry encodes its position, so no block needs to be stored
+	v3Hash := common.Hash{0x03}
+	v3entry, err := proto.Marshal(&ProtoLegacyTxLookupEntry{BlockIndex: 4, Index: 9, Hash: &common.ProtoHash{Value: v3Hash.Bytes()}})
+	require.NoError(t, err)
+	writeTxLookupEntry(db, v3Hash, v3entry)
+	WriteTxLookupEntries(db, 1, []common.Hash{v6tx.Hash()})
+	WriteHeaderNumber(db, v4block.Hash(), 2)
+	writeTxLookupEntry(db, v4tx.Hash(), v4block.Hash().Bytes())
+	// A v6 entry pointing at a block which does not hold the transaction
+	WriteTxLookupEntries(db, 2, []common.Hash{{0x06}})
+
+	tests := []struct {
+		hash          common.Hash
+		number, index uint64
+		ok            bool
+	}{
+		{v3Hash, 4, 9, true},
+		{v6tx.Hash(), 1, 1, true},
+		{v4tx.Hash(), 2, 0, true},
+		{common.Hash{0x06}, 0, 0, false},
+		{common.Hash{0xff}, 0, 0, false},
+	}
+	for i, test := range tests {
+		number, index, ok := ReadTransactionPosition(db, test.hash)
+		require.Equalf(t, test.ok, ok, "test %d: wrong ok", i)
+		require.Equalf(t, test.number, number, "test %d: wrong block number", i)
+		require.Equalf(t, test.index, index, "test %d: wrong index", i)
+	}
+}
+
+func TestFindStaleTxLookupEntries(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	valid1, valid2, orphaned := createTransaction(1), createTransaction(2), createTransaction(3)
+	writeCanonicalBlock(db, 1, types.Transactions{valid1, valid2})
+
+	// The orphaned transaction lives in a block which lost the canonical slot
+	sidechain := createBlockWithTransactions(types.Transactions{orphaned})
+	sidechain.SetNumber(big.NewInt(2), common.ZONE_CTX)
+	sidechain.SetParentHash(common.Hash{0x01}, common.ZONE_CTX)
+	WriteWorkObject(db, sidechain.Hash(), sidechain, types.BlockObject, common.ZONE_CTX)
+	canonical := writeCanonicalBlock(db, 2, types.Transactions{})
+	require.NotEqual(t, sidechain.Hash(), canonical.Hash())
+
+	dangling := common.Hash{0x01}
+	WriteTxLookupEntries(db, 1, []common.Hash{valid1.Hash(), valid2.Hash()})
+	WriteTxLookupEntries(db, 2, []common.Hash{orphaned.Hash()})
+	WriteTxLookupEntries(db, 9, []common.Hash{dangling})
+
+	// Entries are visited in key order, so derive the expected samples from it
+	ordered := []common.Hash{valid1.Hash(), valid2.Hash(), orphaned.Hash(), dangling}
+	sort.Slice(ordered, func(i, j int) bool { return bytes.Compare(ordered[i][:], ordered[j][:]) < 0 })
+	isStale := map[common.Hash]bool{orphaned.Hash(): true, dangling: true}
+
+	for _, sampleEvery := range []int{1, 2, 3, 4, 5} {
+		var want []common.Hash
+		for i, hash := range ordered {
+			if i%sampleEvery == 0 && isStale[hash] {
+				want = append(want, hash)
+			}
+		}
+		stale, err := FindStaleTxLookupEntries(db, sampleEvery)
+		require.NoError(t, err)
+		require.Equalf(t, want, stale, "wrong stale entries sampling every %d", sampleEvery)
+	}
+
+	_, err := FindStaleTxLookupEntries(db, 0)
+	require.Error(t, err, "Invalid sample interval accepted")
+}
+
+func TestReadRecentTransactions(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	txs := make(types.Transactions, 6)
+	for i := range txs {
+		txs[i] = createTransaction(uint64(i))
+	}
+	writeCanonicalBlock(db, 0, types.Transactions{txs[0]})
+	writeCanonicalBlock(db, 1, types.Transactions{txs[1], txs[2]})
+	writeCanonicalBlock(db, 2, types.Transactions{txs[3]})
+	// Block 3 is missing
+	writeCanonicalBlock(db, 4, types.Transactions{})
+	writeCanonicalBlock(db, 5, types.Transactions{txs[4], txs[5]})
+
+	hashes := func(txs []*types.Transaction) []common.Hash {
+		out := make([]common.Hash, len(txs))
+		for i, tx := range txs {
+			out[i] = tx.Hash()
+		}
+		return out
+	}
+	// The walk stops at genesis, newest transaction first
+	recent, numbers := ReadRecentTransactions(db, 2, 10)
+	require.Equal(t, hashes(types.Transactions{txs[3], txs[2], txs[1], txs[0]}), hashes(recent))
+	require.Equal(t, []uint64{2, 1, 1, 0}, numbers)
+
+	// The count cap applies within a block
+	recent, numbers = ReadRecentTransactions(db, 2, 2)
+	require.Equal(t, hashes(types.Transactions{txs[3], txs[2]}), hashes(recent))
+	require.Equal(t, []uint64{2, 1}, numbers)
+
+	// The walk stops at the missing block
+	recent, numbers = ReadRecentTransactions(db, 5, 10)
+	require.Equal(t, hashes(types.Transactions{txs[5], txs[4]}), hashes(recent))
+	require.Equal(t, []uint64{5, 5}, numbers)
+
+	recent, numbers = ReadRecentTransactions(db, 2, 0)
+	require.Empty(t, recent)
+	require.Empty(t, numbers)
+}
+
+func TestReadAdjacentTransactions(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3 := createTransaction(1), createTransaction(2), createTransaction(3)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2, tx3})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	prev, next, prevHash, nextHash := ReadAdjacentTransactions(db, tx2.Hash())
+	require.Equal(t, tx1.Hash(), prev.Hash())
+	require.Equal(t, tx3.Hash(), next.Hash())
+	require.Equal(t, tx1.Hash(), prevHash)
+	require.Equal(t, tx3.Hash(), nextHash)
+
+	prev, next, prevHash, nextHash = ReadAdjacentTransactions(db, tx1.Hash())
+	require.Nil(t, prev, "Transaction before the first returned")
+	require.Equal(t, common.Hash{}, prevHash)
+	require.Equal(t, tx2.Hash(), next.Hash())
+	require.Equal(t, tx2.Hash(), nextHash)
+
+	prev, next, prevHash, nextHash = ReadAdjacentTransactions(db, tx3.Hash())
+	require.Equal(t, tx2.Hash(), prev.Hash())
+	require.Equal(t, tx2.Hash(), prevHash)
+	require.Nil(t, next, "Transaction after the last returned")
+	require.Equal(t, common.Hash{}, nextHash)
+
+	// Neither an unknown transaction nor one whose block is missing resolves
+	WriteTxLookupEntries(db, 2, []common.Hash{{0x02}})
+	for _, hash := range []common.Hash{{0x01}, {0x02}} {
+		prev, next, prevHash, nextHash = ReadAdjacentTransactions(db, hash)
+		require.Nil(t, prev)
+		require.Nil(t, next)
+		require.Equal(t, common.Hash{}, prevHash)
+		require.Equal(t, common.Hash{}, nextHash)
+	}
+}
+
+func TestMustReadTransaction(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	loc, err := MustReadTransaction(db, tx2.Hash())
+	require.NoError(t, err)
+	require.Equal(t, tx2.Hash(), loc.Tx.Hash())
+	require.Equal(t, block.Hash(), loc.BlockHash)
+	require.Equal(t, uint64(1), loc.BlockNumber)
+	require.Equal(t, uint64(1), loc.Index)
+
+	// A lookup entry pointing at a missing block is as unresolvable as none
+	WriteTxLookupEntries(db, 2, []common.Hash{{0x02}})
+	for _, hash := range []common.Hash{{0x01}, {0x02}} {
+		loc, err = MustReadTransaction(db, hash)
+		require.ErrorIs(t, err, ErrTxNotFound)
+		require.Nil(t, loc, "Partial location returned")
+	}
+}
+
+func TestReadTransactionByNumberAndIndex(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+
+	for index, want := range []*types.Transaction{tx1, tx2} {
+		tx, blockHash := ReadTransactionByNumberAndIndex(db, 1, uint64(index))
+		require.Equal(t, want.Hash(), tx.Hash())
+		require.Equal(t, block.Hash(), blockHash)
+	}
+
+	tx, blockHash := ReadTransactionByNumberAndIndex(db, 1, 2)
+	require.Nil(t, tx, "Out of range transaction returned")
+	require.Equal(t, common.Hash{}, blockHash)
+
+	tx, blockHash = ReadTransactionByNumberAndIndex(db, 2, 0)
+	require.Nil(t, tx, "Transaction of missing block returned")
+	require.Equal(t, common.Hash{}, blockHash)
+
+	// A canonical hash whose block is missing
+	WriteCanonicalHash(db, common.Hash{0x03}, 3)
+	tx, blockHash = ReadTransactionByNumberAndIndex(db, 3, 0)
+	require.Nil(t, tx, "Transaction of missing block returned")
+	require.Equal(t, common.Hash{}, blockHash)
+}
+
+func TestResolveTransactionCanonicalBlock(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx, orphaned := createTransaction(1), createTransaction(2)
+	writeCanonicalBlock(db, 1, types.Transactions{tx})
+	WriteTxLookupEntries(db, 1, []common.Hash{tx.Hash()})
+
+	number, canonical := ResolveTransactionCanonicalBlock(db, tx.Hash())
+	require.True(t, canonical)
+	require.Equal(t, uint64(1), number)
+
+	// The index still points at block 2, whose canonical block no longer holds
+	// the transaction after a reorg
+	writeCanonicalBlock(db, 2, types.Transactions{createTransaction(3)})
+	WriteTxLookupEntries(db, 2, []common.Hash{orphaned.Hash()})
+	number, canonical = ResolveTransactionCanonicalBlock(db, orphaned.Hash())
+	require.False(t, canonical, "Orphaned transaction reported canonical")
+	require.Equal(t, uint64(2), number)
+
+	number, canonical = ResolveTransactionCanonicalBlock(db, common.Hash{0xff})
+	require.False(t, canonical)
+	require.Zero(t, number)
+}
+
+func TestFindTransactionInBlocks(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	writeCanonicalBlock(db, 1, types.Transactions{tx1})
+	writeCanonicalBlock(db, 3, types.Transactions{createTransaction(3), tx2})
+
+	// No lookup entries are written, and the missing block 2 is skipped
+	tx, number, index := FindTransactionInBlocks(db, tx2.Hash(), []uint64{2, 1, 3})
+	require.Equal(t, tx2.Hash(), tx.Hash())
+	require.Equal(t, uint64(3), number)
+	require.Equal(t, uint64(1), index)
+
+	tx, number, index = FindTransactionInBlocks(db, tx2.Hash(), []uint64{1, 2})
+	require.Nil(t, tx, "Transaction found outside the candidates")
+	require.Zero(t, number)
+	require.Zero(t, index)
+}
+
+func TestReadTransactionWithConfirmations(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx := createTransaction(1)
+	block := writeCanonicalBlock(db, 5, types.Transactions{tx})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	tests := []struct {
+		head          uint64
+		confirmations uint64
+	}{
+		{8, 3},
+		{6, 1},
+		{5, 0},
+		{2, 0}, // Head behind the block, clamped
+	}
+	for i, test := range tests {
+		rtx, blockHash, number, index, confirmations := ReadTransactionWithConfirmations(db, tx.Hash(), test.head)
+		require.Equalf(t, tx.Hash(), rtx.Hash(), "test %d: wrong transaction", i)
+		require.Equalf(t, block.Hash(), blockHash, "test %d: wrong block hash", i)
+		require.Equalf(t, uint64(5), number, "test %d: wrong block number", i)
+		require.Equalf(t, uint64(0), index, "test %d: wrong index", i)
+		require.Equalf(t, test.confirmations, confirmations, "test %d: wrong confirmations", i)
+	}
+
+	rtx, _, _, _, confirmations := ReadTransactionWithConfirmations(db, common.Hash{0xff}, 8)
+	require.Nil(t, rtx, "Unknown transaction returned")
+	require.Zero(t, confirmations)
+}
+
+func TestTxLookupIndexSize(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	keyBytes, valueBytes, count, err := TxLookupIndexSize(db)
+	require.NoError(t, err)
+	require.Zero(t, keyBytes+valueBytes+count, "Empty index measured")
+
+	WriteTxLookupEntries(db, 0x01, []common.Hash{{1}})
+	WriteTxLookupEntries(db, 0x0102, []common.Hash{{2}})
+	writeTxLookupEntry(db, common.Hash{3}, common.Hash{0xbb}.Bytes())
+	// Neither the multi-value list, the reorg markers nor unrelated keys sharing
+	// the prefix are part of the index
+	WriteTxLookupEntriesMultiValue(db, 7, []common.Hash{{4}})
+	require.NoError(t, db.Delete(txLookupKey(common.Hash{4})))
+	MarkTxReorgedOut(db, common.Hash{5}, 9)
+	require.NoError(t, db.Put(append(common.CopyBytes(txLookupPrefix), 0x01), []byte{0x01}))
+
+	keyBytes, valueBytes, count, err = TxLookupIndexSize(db)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+	require.Equal(t, uint64(3*(len(txLookupPrefix)+common.HashLength)), keyBytes)
+	require.Equal(t, uint64(1+2+common.HashLength), valueBytes)
+}
+
+func TestReadTransactionWithHeader(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	tx, header, blockHash, number, index := ReadTransactionWithHeader(db, tx2.Hash())
+	require.Equal(t, tx2.Hash(), tx.Hash())
+	require.NotNil(t, header)
+	require.Equal(t, block.WorkObjectHeader().Hash(), header.Hash())
+	require.Equal(t, block.Hash(), blockHash)
+	require.Equal(t, uint64(1), number)
+	require.Equal(t, uint64(1), index)
+
+	tx, header, _, _, _ = ReadTransactionWithHeader(db, common.Hash{0xff})
+	require.Nil(t, tx, "Unknown transaction returned")
+	require.Nil(t, header, "Header of unknown transaction returned")
+}
+
+func TestReadTransactionProofData(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2 := createTransaction(1), createTransaction(2)
+	block := writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2})
+	WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+
+	tx, index, header, blockHash := ReadTransactionProofData(db, tx2.Hash())
+	require.Equal(t, tx2.Hash(), tx.Hash())
+	require.Equal(t, uint64(1), index)
+	require.NotNil(t, header)
+	require.Equal(t, block.WorkObjectHeader().Hash(), header.Hash())
+	require.Equal(t, block.Hash(), blockHash)
+
+	// A lookup entry pointing at a missing block yields no proof data
+	WriteTxLookupEntries(db, 2, []common.Hash{{0x02}})
+	for _, hash := range []common.Hash{{0x01}, {0x02}} {
+		tx, index, header, blockHash = ReadTransactionProofData(db, hash)
+		require.Nil(t, tx)
+		require.Zero(t, index)
+		require.Nil(t, header)
+		require.Equal(t, common.Hash{}, blockHash)
+	}
+}
+
+func TestReadTransactionWithPositionFlags(t *testing.T) {
+	db := NewMemoryDatabase(log.Global)
+	tx1, tx2, tx3, single := createTransaction(1), createTransaction(2), createTransaction(3), createTransaction(4)
+	for _, block := range []*types.WorkObject{
+		writeCanonicalBlock(db, 1, types.Transactions{tx1, tx2, tx3}),
+		writeCanonicalBlock(db, 2, types.Transactions{single}),
+	} {
+		WriteTxLookupEntriesByBlock(db, block, common.ZONE_CTX)
+	}
+
+	tests := []struct {
+		tx            *types.Transaction
+		number, index uint64
+		first, last   bool
+	}{
+		{tx1, 1, 0, true, false},
+		{tx2, 1, 1, false, false},
+		{tx3, 1, 2, false, true},
+		{single, 2, 0, true, true},
+	}
+	for i, test := range tests {
+		tx, _, number, index, first, last := ReadTransactionWithPositionFlags(db, test.tx.Hash())
+		require.Equalf(t, test.tx.Hash(), tx.Hash(), "test %d: wrong transaction", i)
+		require.Equalf(t, test.number, number, "test %d: wrong block number", i)
+		require.Equalf(t, test.index, index, "test %d: wrong index", i)
+		require.Equalf(t, test.first, first, "test %d: wrong first flag", i)
+		require.Equalf(t, test.last, last, "test %d: wrong last flag", i)
+	}
+
+	tx, _, _, _, first, last := ReadTransactionWithPositionFlags(db, common.Hash{0xff})
+	require.Nil(t, tx, "Unknown transaction returned")
+	require.False(t, first)
+	require.False(t, last)
+}
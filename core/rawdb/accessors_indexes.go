@@ -18,12 +18,22 @@ package rawdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/big"
+	"sort"
 
 	"github.com/dominant-strategies/go-quai/common"
+	"github.com/dominant-strategies/go-quai/common/bitutil"
+	"github.com/dominant-strategies/go-quai/core/bloombits"
 	"github.com/dominant-strategies/go-quai/core/types"
+	"github.com/dominant-strategies/go-quai/crypto"
 	"github.com/dominant-strategies/go-quai/ethdb"
 	"github.com/dominant-strategies/go-quai/log"
+	"github.com/dominant-strategies/go-quai/params"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -34,29 +44,193 @@ func ReadTxLookupEntry(db ethdb.Reader, hash common.Hash) *uint64 {
 	if len(data) == 0 {
 		return nil
 	}
+	return decodeTxLookupEntry(db, hash, data)
+}
+
+// ReadTxLookupEntryMultiValue is the multi-value counterpart of
+// ReadTxLookupEntry, for indexes written with WriteTxLookupEntriesMultiValue.
+// If several entries are stored for the hash, the entry whose canonical block
+// actually contains the transaction is returned, falling back to the
+// single-value entry if none of them does.
+func ReadTxLookupEntryMultiValue(db ethdb.Reader, hash common.Hash) *uint64 {
+	number := ReadTxLookupEntry(db, hash)
+	if number == nil {
+		return nil
+	}
+	entries := ReadTxLookupEntries(db, hash)
+	if len(entries) < 2 {
+		return number
+	}
+	for _, entry := range entries {
+		if canonicalBlockContainsTx(db, entry, hash) {
+			return &entry
+		}
+	}
+	return number
+}
+
+// ReadTxLookupEntries retrieves the block numbers of all lookup entries stored
+// for a transaction hash, including the ones recorded by
+// WriteTxLookupEntriesMultiValue. The multi-value list can only be read if the
+// database supports iteration.
+func ReadTxLookupEntries(db ethdb.Reader, hash common.Hash) []uint64 {
+	var (
+		entries []uint64
+		seen    = make(map[uint64]struct{})
+	)
+	appendEntry := func(number *uint64) {
+		if number == nil {
+			return
+		}
+		if _, ok := seen[*number]; !ok {
+			seen[*number] = struct{}{}
+			entries = append(entries, *number)
+		}
+	}
+	if data, _ := db.Get(txLookupKey(hash)); len(data) > 0 {
+		appendEntry(decodeTxLookupEntry(db, hash, data))
+	}
+	iteratee, ok := db.(ethdb.Iteratee)
+	if !ok {
+		return entries
+	}
+	prefix := txLookupListKey(hash, nil)
+	it := iteratee.NewIterator(prefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		if value := it.Key()[len(prefix):]; len(value) > 0 {
+			appendEntry(decodeTxLookupEntry(db, hash, value))
+		}
+	}
+	return entries
+}
+
+// canonicalBlockContainsTx reports whether the canonical block at the given
+// number contains the transaction.
+func canonicalBlockContainsTx(db ethdb.Reader, number uint64, hash common.Hash) bool {
+	blockHash := ReadCanonicalHash(db, number)
+	if blockHash == (common.Hash{}) {
+		return false
+	}
+	hashes, _ := ReadTransactionHashes(db, number, blockHash)
+	for _, txHash := range hashes {
+		if txHash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveTransactionCanonicalBlock returns the block number the tx lookup index
+// holds for a transaction, and whether the canonical block at that number
+// actually contains it. This distinguishes an indexed transaction that has
+// been orphaned by a reorg from one that is on the canonical chain.
+func ResolveTransactionCanonicalBlock(db ethdb.Reader, hash common.Hash) (uint64, bool) {
+	number := ReadTxLookupEntry(db, hash)
+	if number == nil {
+		return 0, false
+	}
+	return *number, canonicalBlockContainsTx(db, *number, hash)
+}
+
+// maxLegacyTxLookupEntryLength is the largest possible encoding of a v3 legacy
+// tx lookup entry: a length prefixed 32 byte block hash wrapped in a ProtoHash
+// (36 bytes) plus two tagged uint64 varints (11 bytes each). Larger values are
+// rejected before attempting a protobuf decode.
+const maxLegacyTxLookupEntryLength = 58
+
+// Tx lookup entries written with a retention hint are encoded as
+// txLookupTTLTag || number (uint64 big endian) || retain until (uint64 big
+// endian). Plain v6 entries store the minimal big endian block number, which
+// never starts with a zero byte, so the tag cannot be mistaken for one.
+const (
+	txLookupTTLTag         = 0x00
+	txLookupTTLEntryLength = 1 + 8 + 8
+)
+
+// Tx lookup entry formats reported by ClassifyTxLookupEntry.
+const (
+	TxLookupFormatEmpty   = "empty"   // No value stored
+	TxLookupFormatV6      = "v6"      // Block number
+	TxLookupFormatTTL     = "v6-ttl"  // Block number with a retention hint
+	TxLookupFormatV4      = "v4-v5"   // Block hash
+	TxLookupFormatV3      = "v3"      // Protobuf encoded LegacyTxLookupEntry
+	TxLookupFormatInvalid = "invalid" // Undecodable value
+)
+
+// ClassifyTxLookupEntry reports which lookup entry format a raw tx lookup value
+// decodes as, using the same length heuristics as ReadTxLookupEntry. The block
+// number is returned for formats which embed it (v6 and v3) and is nil
+// otherwise. Values that decode, but are ambiguous between formats or could not
+// have been produced by the writers, are flagged as suspicious:
+//   - v6 numbers with leading zero bytes or that overflow a uint64
+//   - v4-v5 hashes that fit in a uint64, which are more likely a mangled number
+//   - v3 entries without a block hash
+func ClassifyTxLookupEntry(data []byte) (string, *uint64, bool) {
+	if len(data) == 0 {
+		return TxLookupFormatEmpty, nil, false
+	}
+	// Database v6 tx lookup with a retention hint
+	if len(data) == txLookupTTLEntryLength && data[0] == txLookupTTLTag {
+		number := binary.BigEndian.Uint64(data[1:])
+		return TxLookupFormatTTL, &number, false
+	}
 	// Database v6 tx lookup just stores the block number
 	if len(data) < common.HashLength {
-		number := new(big.Int).SetBytes(data).Uint64()
-		return &number
+		number := new(big.Int).SetBytes(data)
+		suspicious := data[0] == 0 || !number.IsUint64()
+		n := number.Uint64()
+		return TxLookupFormatV6, &n, suspicious
 	}
 	// Database v4-v5 tx lookup format just stores the hash
 	if len(data) == common.HashLength {
-		return ReadHeaderNumber(db, common.BytesToHash(data))
+		suspicious := bytes.Equal(data[:common.HashLength-8], make([]byte, common.HashLength-8))
+		return TxLookupFormatV4, nil, suspicious
 	}
 	// Finally try database v3 tx lookup format
+	if len(data) > maxLegacyTxLookupEntryLength {
+		return TxLookupFormatInvalid, nil, true
+	}
 	protoLegacyTxLookupEntry := new(ProtoLegacyTxLookupEntry)
-	err := proto.Unmarshal(data, protoLegacyTxLookupEntry)
-	if err != nil {
+	if err := proto.Unmarshal(data, protoLegacyTxLookupEntry); err != nil {
+		return TxLookupFormatInvalid, nil, true
+	}
+	entry := new(LegacyTxLookupEntry)
+	entry.ProtoDecode(protoLegacyTxLookupEntry)
+	return TxLookupFormatV3, &entry.BlockIndex, entry.BlockHash == (common.Hash{})
+}
+
+// decodeTxLookupEntry decodes the block number out of a raw tx lookup value,
+// supporting every historical lookup entry format.
+func decodeTxLookupEntry(db ethdb.KeyValueReader, hash common.Hash, data []byte) *uint64 {
+	format, number, _ := ClassifyTxLookupEntry(data)
+	switch format {
+	case TxLookupFormatV4:
+		return ReadHeaderNumber(db, common.BytesToHash(data))
+	case TxLookupFormatInvalid:
+		if len(data) > maxLegacyTxLookupEntryLength {
+			db.Logger().WithFields(log.Fields{
+				"hash": hash,
+				"size": len(data),
+				"max":  maxLegacyTxLookupEntryLength,
+			}).Warn("Oversized transaction lookup entry")
+			return nil
+		}
 		db.Logger().WithFields(log.Fields{
 			"hash": hash,
 			"blob": data,
-			"err":  err,
 		}).Error("Invalid transaction lookup entry protobuf")
 		return nil
 	}
-	entry := new(LegacyTxLookupEntry)
-	entry.ProtoDecode(protoLegacyTxLookupEntry)
-	return &entry.BlockIndex
+	return number
+}
+
+// HasTxLookupEntry verifies the existence of a lookup entry for a transaction
+// hash, without decoding it.
+func HasTxLookupEntry(db ethdb.KeyValueReader, hash common.Hash) bool {
+	has, err := db.Has(txLookupKey(hash))
+	return err == nil && has
 }
 
 // writeTxLookupEntry stores a positional metadata for a transaction,
@@ -76,6 +250,22 @@ func WriteTxLookupEntries(db ethdb.KeyValueWriter, number uint64, hashes []commo
 	}
 }
 
+// WriteTxLookupEntriesMultiValue is the multi-value counterpart of
+// WriteTxLookupEntries. Besides overwriting the single-value entry, which stays
+// the fast path of ReadTxLookupEntry, every entry is appended to a per-hash
+// list, so that a hash colliding across forks does not silently lose the entry
+// of the other transaction. Such indexes must be read with
+// ReadTxLookupEntryMultiValue and pruned with DeleteTxLookupEntryMultiValue.
+func WriteTxLookupEntriesMultiValue(db ethdb.KeyValueWriter, number uint64, hashes []common.Hash) {
+	numberBytes := new(big.Int).SetUint64(number).Bytes()
+	for _, hash := range hashes {
+		writeTxLookupEntry(db, hash, numberBytes)
+		if err := db.Put(txLookupListKey(hash, numberBytes), nil); err != nil {
+			db.Logger().WithField("err", err).Fatal("Failed to store transaction lookup list entry")
+		}
+	}
+}
+
 // WriteTxLookupEntriesByBlock stores a positional metadata for every transaction from
 // a block, enabling hash based transaction and receipt lookups.
 func WriteTxLookupEntriesByBlock(db ethdb.KeyValueWriter, wo *types.WorkObject, nodeCtx int) {
@@ -85,6 +275,171 @@ func WriteTxLookupEntriesByBlock(db ethdb.KeyValueWriter, wo *types.WorkObject,
 	}
 }
 
+// ReadTxIndexHighWater retrieves the tx index high water mark, the highest
+// block number whose transactions were indexed, if one has been recorded.
+func ReadTxIndexHighWater(db ethdb.KeyValueReader) (uint64, bool) {
+	data, _ := db.Get(txIndexHighWaterKey)
+	if len(data) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(data), true
+}
+
+// WriteTxIndexHighWater raises the tx index high water mark to number, leaving
+// it untouched if the mark read from reader is already as high. The new mark is
+// issued to db, which is typically a batch over reader, so that the block
+// writers can record it together with the lookup entries; as the check reads
+// reader, a mark still pending in that same batch is not taken into account.
+// The mark is advisory: it tracks indexing progress but does not guarantee that
+// every block below it is indexed.
+func WriteTxIndexHighWater(reader ethdb.KeyValueReader, db ethdb.KeyValueWriter, number uint64) {
+	if current, ok := ReadTxIndexHighWater(reader); ok && current >= number {
+		return
+	}
+	if err := db.Put(txIndexHighWaterKey, encodeBlockNumber(number)); err != nil {
+		db.Logger().WithField("err", err).Fatal("Failed to store tx index high water mark")
+	}
+}
+
+// RepairTxLookupGaps writes the missing tx lookup entries of the canonical
+// blocks in the inclusive range [from, to], leaving existing entries untouched
+// to avoid rewriting an index that is mostly intact. Closing interrupt stops the
+// repair after flushing the entries written so far. The number of entries added
+// is returned.
+func RepairTxLookupGaps(db ethdb.Database, from, to uint64, interrupt chan struct{}) (repaired int, err error) {
+	batch := db.NewBatch()
+	for number := from; number <= to; number++ {
+		select {
+		case <-interrupt:
+			return repaired, batch.Write()
+		default:
+		}
+		hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number))
+		if ok {
+			var missing []common.Hash
+			for _, hash := range hashes {
+				if !HasTxLookupEntry(db, hash) {
+					missing = append(missing, hash)
+				}
+			}
+			WriteTxLookupEntries(batch, number, missing)
+			repaired += len(missing)
+			if batch.ValueSize() >= ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					return repaired, err
+				}
+				batch.Reset()
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return repaired, batch.Write()
+}
+
+// ReplaceTxLookupEntriesForBlock queues into the batch the removal of the
+// lookup entries of every transaction in oldWo that is not in newWo, followed by
+// the lookup entries of every transaction in newWo, so that flushing the batch
+// atomically swaps a block's lookup set. Flushing is left to the caller.
+func ReplaceTxLookupEntriesForBlock(db ethdb.Batch, oldWo, newWo *types.WorkObject, nodeCtx int) {
+	keep := make(map[common.Hash]struct{}, len(newWo.Body().Transactions()))
+	for _, tx := range newWo.Body().Transactions() {
+		keep[tx.Hash()] = struct{}{}
+	}
+	for _, tx := range oldWo.Body().Transactions() {
+		if _, ok := keep[tx.Hash()]; !ok {
+			DeleteTxLookupEntry(db, tx.Hash())
+		}
+	}
+	WriteTxLookupEntriesByBlock(db, newWo, nodeCtx)
+}
+
+// OnReorgInvalidateTxs invokes invalidate for every transaction whose resolved
+// position is affected by replacing oldWo with newWo during a reorg: those only
+// present in one of the two blocks, and those present in both but moved to a
+// different block, number or index. A transaction kept at the same index of a
+// replacement block at the same height is still reported, as its block hash and
+// thus any cached lookup or receipt has changed. Either block may be nil.
+func OnReorgInvalidateTxs(oldWo, newWo *types.WorkObject, nodeCtx int, invalidate func(common.Hash)) {
+	type position struct {
+		block  common.Hash
+		number uint64
+		index  int
+	}
+	positions := func(wo *types.WorkObject) map[common.Hash]position {
+		txs := make(map[common.Hash]position)
+		if wo == nil {
+			return txs
+		}
+		block, number := wo.Hash(), wo.NumberU64(nodeCtx)
+		for i, tx := range wo.Body().Transactions() {
+			txs[tx.Hash()] = position{block, number, i}
+		}
+		return txs
+	}
+	oldTxs, newTxs := positions(oldWo), positions(newWo)
+	for hash, oldPos := range oldTxs {
+		newPos, ok := newTxs[hash]
+		if !ok || newPos != oldPos {
+			invalidate(hash)
+		}
+	}
+	for hash := range newTxs {
+		if _, ok := oldTxs[hash]; !ok {
+			invalidate(hash)
+		}
+	}
+}
+
+// WriteTxLookupEntriesByBlockTTL is identical to WriteTxLookupEntriesByBlock,
+// but additionally records in each entry that it only needs to be retained
+// until retainUntilBlock, allowing SweepExpiredTxLookups to prune it later.
+func WriteTxLookupEntriesByBlockTTL(db ethdb.KeyValueWriter, wo *types.WorkObject, nodeCtx int, retainUntilBlock uint64) {
+	value := make([]byte, txLookupTTLEntryLength)
+	value[0] = txLookupTTLTag
+	binary.BigEndian.PutUint64(value[1:], wo.NumberU64(nodeCtx))
+	binary.BigEndian.PutUint64(value[9:], retainUntilBlock)
+	for _, tx := range wo.Body().Transactions() {
+		writeTxLookupEntry(db, tx.Hash(), value)
+	}
+}
+
+// SweepExpiredTxLookups deletes every tx lookup entry whose retention hint lies
+// before currentBlock, returning the number of entries deleted. Entries written
+// without a retention hint are never swept.
+func SweepExpiredTxLookups(db ethdb.Database, currentBlock uint64) (int, error) {
+	it := db.NewIterator(txLookupPrefix, nil)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	swept := 0
+	for it.Next() {
+		key, value := it.Key(), it.Value()
+		if len(key) != len(txLookupPrefix)+common.HashLength {
+			continue
+		}
+		if len(value) != txLookupTTLEntryLength || value[0] != txLookupTTLTag {
+			continue
+		}
+		if binary.BigEndian.Uint64(value[9:]) >= currentBlock {
+			continue
+		}
+		DeleteTxLookupEntry(batch, common.BytesToHash(key[len(txLookupPrefix):]))
+		swept++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return swept, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return swept, err
+	}
+	return swept, batch.Write()
+}
+
 // DeleteTxLookupEntry removes all transaction data associated with a hash.
 func DeleteTxLookupEntry(db ethdb.KeyValueWriter, hash common.Hash) {
 	if err := db.Delete(txLookupKey(hash)); err != nil {
@@ -92,6 +447,26 @@ func DeleteTxLookupEntry(db ethdb.KeyValueWriter, hash common.Hash) {
 	}
 }
 
+// DeleteTxLookupEntryMultiValue removes the single-value lookup entry of a hash
+// along with every entry of its multi-value list. The list is enumerated from
+// reader and the deletions are issued to db, so db may be a batch over reader;
+// list entries still pending in that same batch are not seen and survive.
+func DeleteTxLookupEntryMultiValue(reader ethdb.Iteratee, db ethdb.KeyValueWriter, hash common.Hash) {
+	DeleteTxLookupEntry(db, hash)
+
+	var keys [][]byte
+	it := reader.NewIterator(txLookupListKey(hash, nil), nil)
+	for it.Next() {
+		keys = append(keys, common.CopyBytes(it.Key()))
+	}
+	it.Release()
+	for _, key := range keys {
+		if err := db.Delete(key); err != nil {
+			db.Logger().WithField("err", err).Fatal("Failed to delete transaction lookup list entry")
+		}
+	}
+}
+
 // DeleteTxLookupEntries removes all transaction lookups for a given block.
 func DeleteTxLookupEntries(db ethdb.KeyValueWriter, hashes []common.Hash) {
 	for _, hash := range hashes {
@@ -99,9 +474,286 @@ func DeleteTxLookupEntries(db ethdb.KeyValueWriter, hashes []common.Hash) {
 	}
 }
 
+// FindStaleTxLookupEntries samples every sampleEvery-th entry of the tx lookup
+// index and returns the hashes of the sampled entries that do not resolve to a
+// transaction in the canonical block they point at. Sampling keeps the probe
+// cheap on large databases while still surfacing systemic corruption.
+func FindStaleTxLookupEntries(db ethdb.Database, sampleEvery int) ([]common.Hash, error) {
+	if sampleEvery < 1 {
+		return nil, fmt.Errorf("invalid sample interval %d", sampleEvery)
+	}
+	it := db.NewIterator(txLookupPrefix, nil)
+	defer it.Release()
+
+	var (
+		stale []common.Hash
+		seen  int
+	)
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(txLookupPrefix)+common.HashLength {
+			continue
+		}
+		seen++
+		if (seen-1)%sampleEvery != 0 {
+			continue
+		}
+		hash := common.BytesToHash(key[len(txLookupPrefix):])
+		number := decodeTxLookupEntry(db, hash, it.Value())
+		if number == nil || !canonicalBlockContainsTx(db, *number, hash) {
+			stale = append(stale, hash)
+		}
+	}
+	return stale, it.Error()
+}
+
+// TxLookupIndexSize returns the storage consumed by the tx lookup index, as
+// the total length of its keys and values along with the number of entries.
+// The values are only measured and never copied.
+func TxLookupIndexSize(db ethdb.Iteratee) (keyBytes, valueBytes uint64, count uint64, err error) {
+	it := db.NewIterator(txLookupPrefix, nil)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(txLookupPrefix)+common.HashLength {
+			continue
+		}
+		keyBytes += uint64(len(key))
+		valueBytes += uint64(len(it.Value()))
+		count++
+	}
+	return keyBytes, valueBytes, count, it.Error()
+}
+
+// MarkTxReorgedOut stores a short-lived marker recording that the transaction
+// was removed from the canonical chain by a reorg at the given block, so that
+// lookups can distinguish a reorged-out transaction from an unknown one.
+func MarkTxReorgedOut(db ethdb.KeyValueWriter, hash common.Hash, intoBlock uint64) {
+	if err := db.Put(txReorgedKey(hash), encodeBlockNumber(intoBlock)); err != nil {
+		db.Logger().WithField("err", err).Fatal("Failed to store reorged transaction marker")
+	}
+}
+
+// ReadTxReorgedOut retrieves the block number of the reorg that removed the
+// transaction from the canonical chain, or nil if no marker is stored.
+func ReadTxReorgedOut(db ethdb.KeyValueReader, hash common.Hash) *uint64 {
+	data, _ := db.Get(txReorgedKey(hash))
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// DeleteTxReorgedOut removes the reorged transaction marker of a hash.
+func DeleteTxReorgedOut(db ethdb.KeyValueWriter, hash common.Hash) {
+	if err := db.Delete(txReorgedKey(hash)); err != nil {
+		db.Logger().WithField("err", err).Fatal("Failed to delete reorged transaction marker")
+	}
+}
+
+// SweepTxReorgedMarkers removes all reorged transaction markers that were
+// written more than retention blocks before currentBlock, returning the number
+// of markers deleted.
+func SweepTxReorgedMarkers(db ethdb.Database, currentBlock uint64, retention uint64) (int, error) {
+	it := db.NewIterator(txReorgedPrefix, nil)
+	defer it.Release()
+
+	batch := db.NewBatch()
+	swept := 0
+	for it.Next() {
+		if len(it.Key()) != len(txReorgedPrefix)+common.HashLength || len(it.Value()) != 8 {
+			continue
+		}
+		if binary.BigEndian.Uint64(it.Value())+retention >= currentBlock {
+			continue
+		}
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return swept, err
+		}
+		swept++
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return swept, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return swept, err
+	}
+	return swept, batch.Write()
+}
+
+// HashTxLookupIndex computes a deterministic digest over the entire tx lookup
+// index. Every entry is normalized to its v6 block number and fed into a Keccak
+// hasher as hash || number (uint64 big endian) in key order, so two databases
+// holding equivalent indexes produce the same digest regardless of which
+// lookup format individual entries were written with.
+func HashTxLookupIndex(db ethdb.Iteratee) (common.Hash, error) {
+	reader, ok := db.(ethdb.KeyValueReader)
+	if !ok {
+		return common.Hash{}, errors.New("database does not support key lookups")
+	}
+	it := db.NewIterator(txLookupPrefix, nil)
+	defer it.Release()
+
+	hasher := crypto.NewKeccakState()
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(txLookupPrefix)+common.HashLength {
+			continue
+		}
+		hash := common.BytesToHash(key[len(txLookupPrefix):])
+		number := decodeTxLookupEntry(reader, hash, it.Value())
+		if number == nil {
+			return common.Hash{}, fmt.Errorf("undecodable tx lookup entry for %s", hash.Hex())
+		}
+		hasher.Write(hash.Bytes())
+		hasher.Write(encodeBlockNumber(*number))
+	}
+	if err := it.Error(); err != nil {
+		return common.Hash{}, err
+	}
+	var digest common.Hash
+	hasher.Read(digest[:])
+	return digest, nil
+}
+
 // ReadTransaction retrieves a specific transaction from the database, along with
 // its added positional metadata.
 func ReadTransaction(db ethdb.Reader, hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64) {
+	wo, blockHash, blockNumber, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, common.Hash{}, 0, 0
+	}
+	return wo.Body().Transactions()[txIndex], blockHash, blockNumber, txIndex
+}
+
+// ReadTransactionWithConfirmations retrieves a specific transaction like
+// ReadTransaction, additionally returning its number of confirmations relative
+// to the given head number. Confirmations are clamped at zero if the
+// transaction's block is ahead of currentHead.
+func ReadTransactionWithConfirmations(db ethdb.Reader, hash common.Hash, currentHead uint64) (*types.Transaction, common.Hash, uint64, uint64, uint64) {
+	tx, blockHash, blockNumber, txIndex := ReadTransaction(db, hash)
+	if tx == nil {
+		return nil, common.Hash{}, 0, 0, 0
+	}
+	var confirmations uint64
+	if currentHead > blockNumber {
+		confirmations = currentHead - blockNumber
+	}
+	return tx, blockHash, blockNumber, txIndex, confirmations
+}
+
+// ReadTransactionWithHeader retrieves a specific transaction like
+// ReadTransaction, additionally returning the header of the block holding it.
+// The header is taken from the block already loaded to resolve the transaction,
+// and is nil if the transaction cannot be resolved.
+func ReadTransactionWithHeader(db ethdb.Reader, hash common.Hash) (*types.Transaction, *types.WorkObjectHeader, common.Hash, uint64, uint64) {
+	wo, blockHash, blockNumber, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, nil, common.Hash{}, 0, 0
+	}
+	return wo.Body().Transactions()[txIndex], wo.WorkObjectHeader(), blockHash, blockNumber, txIndex
+}
+
+// ReadTransactionProofData retrieves the inputs needed to prove the inclusion
+// of a transaction: the transaction, its index within the block, the block
+// header and the block hash, all taken from the block loaded once to resolve
+// the transaction. Nils and zero values are returned if the transaction cannot
+// be resolved.
+func ReadTransactionProofData(db ethdb.Reader, hash common.Hash) (*types.Transaction, uint64, *types.WorkObjectHeader, common.Hash) {
+	wo, blockHash, _, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, 0, nil, common.Hash{}
+	}
+	return wo.Body().Transactions()[txIndex], txIndex, wo.WorkObjectHeader(), blockHash
+}
+
+// ReadTransactionWithPositionFlags retrieves a specific transaction like
+// ReadTransaction, additionally reporting whether it is the first and whether
+// it is the last transaction of its block, as computed from the body loaded to
+// resolve it.
+func ReadTransactionWithPositionFlags(db ethdb.Reader, hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64, bool, bool) {
+	wo, blockHash, blockNumber, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, common.Hash{}, 0, 0, false, false
+	}
+	txs := wo.Body().Transactions()
+	return txs[txIndex], blockHash, blockNumber, txIndex, txIndex == 0, txIndex == uint64(len(txs)-1)
+}
+
+// ReadTransactionAndReceipt retrieves a specific transaction together with its
+// receipt, along with their added positional metadata. The block is loaded once
+// and reused to derive the receipt fields. Nils and zero values are returned if
+// the transaction cannot be resolved or its receipts are missing.
+func ReadTransactionAndReceipt(db ethdb.Reader, hash common.Hash, config *params.ChainConfig) (*types.Transaction, *types.Receipt, common.Hash, uint64, uint64) {
+	wo, blockHash, blockNumber, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, nil, common.Hash{}, 0, 0
+	}
+	receipts := ReadRawReceipts(db, blockHash, blockNumber)
+	if uint64(len(receipts)) <= txIndex {
+		db.Logger().WithFields(log.Fields{
+			"number": blockNumber,
+			"hash":   blockHash,
+			"txhash": hash,
+		}).Error("Receipt not found")
+		return nil, nil, common.Hash{}, 0, 0
+	}
+	txs := wo.Body().Transactions()
+	if err := receipts.DeriveFields(config, blockHash, blockNumber, txs); err != nil {
+		db.Logger().WithFields(log.Fields{
+			"hash":   blockHash,
+			"number": blockNumber,
+			"err":    err,
+		}).Error("Failed to derive block receipts fields")
+		return nil, nil, common.Hash{}, 0, 0
+	}
+	return txs[txIndex], receipts[txIndex], blockHash, blockNumber, txIndex
+}
+
+// ReadTransactionCumulativeGas returns the gas used by the block holding a
+// transaction up to and including that transaction, along with the gas used by
+// the whole block. The cumulative gas is stored in the raw receipts, so no
+// fields need deriving. Zeros and false are returned if the transaction or its
+// receipts are missing.
+func ReadTransactionCumulativeGas(db ethdb.Reader, hash common.Hash) (cumulativeGas uint64, blockGasUsed uint64, ok bool) {
+	wo, blockHash, blockNumber, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return 0, 0, false
+	}
+	receipts := ReadRawReceipts(db, blockHash, blockNumber)
+	if len(receipts) != len(wo.Body().Transactions()) {
+		return 0, 0, false
+	}
+	return receipts[txIndex].CumulativeGasUsed, receipts[len(receipts)-1].CumulativeGasUsed, true
+}
+
+// ReadTransactionPositionPercentile retrieves a specific transaction along with
+// its position within its block as a fraction of the block's transactions,
+// from 0 for the first to 1 for the last. The percentile is undefined for
+// single transaction blocks, for which the transaction is returned with 0 and
+// false, as is a nil transaction if it cannot be resolved.
+func ReadTransactionPositionPercentile(db ethdb.Reader, hash common.Hash) (*types.Transaction, float64, bool) {
+	wo, _, _, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, 0, false
+	}
+	txs := wo.Body().Transactions()
+	if len(txs) < 2 {
+		return txs[txIndex], 0, false
+	}
+	return txs[txIndex], float64(txIndex) / float64(len(txs)-1), true
+}
+
+// resolveTransaction resolves the canonical block holding a transaction through
+// the tx lookup index, returning the loaded block, its hash and number, and the
+// index of the transaction within it. A nil block is returned if the transaction
+// cannot be resolved.
+func resolveTransaction(db ethdb.Reader, hash common.Hash) (*types.WorkObject, common.Hash, uint64, uint64) {
 	blockNumber := ReadTxLookupEntry(db, hash)
 	if blockNumber == nil {
 		return nil, common.Hash{}, 0, 0
@@ -120,7 +772,7 @@ func ReadTransaction(db ethdb.Reader, hash common.Hash) (*types.Transaction, com
 	}
 	for txIndex, tx := range wo.Body().Transactions() {
 		if tx.Hash() == hash {
-			return tx, blockHash, *blockNumber, uint64(txIndex)
+			return wo, blockHash, *blockNumber, uint64(txIndex)
 		}
 	}
 	db.Logger().WithFields(log.Fields{
@@ -131,37 +783,1071 @@ func ReadTransaction(db ethdb.Reader, hash common.Hash) (*types.Transaction, com
 	return nil, common.Hash{}, 0, 0
 }
 
-// ReadBloomBits retrieves the compressed bloom bit vector belonging to the given
-// section and bit index from the.
-func ReadBloomBits(db ethdb.KeyValueReader, bit uint, section uint64, head common.Hash) ([]byte, error) {
-	return db.Get(bloomBitsKey(bit, section, head))
+// ReadAdjacentTransactions retrieves the transactions immediately before and
+// after the given transaction within its block, along with their hashes. Nil
+// transactions and empty hashes are returned at the block boundaries or if the
+// transaction cannot be resolved.
+func ReadAdjacentTransactions(db ethdb.Reader, hash common.Hash) (*types.Transaction, *types.Transaction, common.Hash, common.Hash) {
+	wo, _, _, txIndex := resolveTransaction(db, hash)
+	if wo == nil {
+		return nil, nil, common.Hash{}, common.Hash{}
+	}
+	var (
+		txs                = wo.Body().Transactions()
+		prev, next         *types.Transaction
+		prevHash, nextHash common.Hash
+	)
+	if txIndex > 0 {
+		prev = txs[txIndex-1]
+		prevHash = prev.Hash()
+	}
+	if txIndex+1 < uint64(len(txs)) {
+		next = txs[txIndex+1]
+		nextHash = next.Hash()
+	}
+	return prev, next, prevHash, nextHash
 }
 
-// WriteBloomBits stores the compressed bloom bits vector belonging to the given
-// section and bit index.
-func WriteBloomBits(db ethdb.KeyValueWriter, bit uint, section uint64, head common.Hash, bits []byte) {
-	if err := db.Put(bloomBitsKey(bit, section, head), bits); err != nil {
-		db.Logger().WithField("err", err).Fatal("Failed to store bloom bits")
+// ReadTransactionByNumberAndIndex retrieves the transaction at the given index
+// of the canonical block with the given number, along with the block hash. Nil
+// is returned if the block is missing or the index is out of range.
+func ReadTransactionByNumberAndIndex(db ethdb.Reader, number uint64, index uint64) (*types.Transaction, common.Hash) {
+	blockHash := ReadCanonicalHash(db, number)
+	if blockHash == (common.Hash{}) {
+		return nil, common.Hash{}
 	}
+	wo := ReadWorkObject(db, number, blockHash, types.BlockObject)
+	if wo == nil {
+		return nil, common.Hash{}
+	}
+	txs := wo.Body().Transactions()
+	if index >= uint64(len(txs)) {
+		return nil, common.Hash{}
+	}
+	return txs[index], blockHash
 }
 
-// DeleteBloombits removes all compressed bloom bits vector belonging to the
-// given section range and bit index.
-func DeleteBloombits(db ethdb.Database, bit uint, from uint64, to uint64) {
-	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
-	it := db.NewIterator(nil, start)
-	defer it.Release()
+// ReadTransactionsByType retrieves, in block order, the transactions of the block
+// whose type matches txType. Only the body is decoded, and as bodies are keyed
+// by hash the number merely keeps the shape of the other block accessors. An
+// empty slice is returned if the block has no matching transactions or its body
+// is missing.
+func ReadTransactionsByType(db ethdb.Reader, number uint64, hash common.Hash, txType uint8) []*types.Transaction {
+	matches := make([]*types.Transaction, 0)
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return matches
+	}
+	for _, tx := range body.Transactions() {
+		if tx.Type() == txType {
+			matches = append(matches, tx)
+		}
+	}
+	return matches
+}
 
-	for it.Next() {
-		if bytes.Compare(it.Key(), end) >= 0 {
-			break
+// ReadBlockTransactionsForAddress retrieves, in block order, the transactions
+// of a block sent by or addressed to addr, recovering senders with the given
+// signer. Transactions whose sender cannot be recovered are matched on their
+// recipient only, and Qi transactions, which carry neither, are skipped. An
+// empty slice is returned if no transaction matches or the block body is
+// missing.
+func ReadBlockTransactionsForAddress(db ethdb.Reader, number uint64, hash common.Hash, addr common.Address, signer types.Signer) []*types.Transaction {
+	matches := make([]*types.Transaction, 0)
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return matches
+	}
+	for _, tx := range body.Transactions() {
+		if tx.Type() == types.QiTxType {
+			continue
 		}
-		if len(it.Key()) != BloomBitsKeyLength {
+		if to := tx.To(); to != nil && to.Equal(addr) {
+			matches = append(matches, tx)
 			continue
 		}
-		db.Delete(it.Key())
+		if from, err := types.Sender(signer, tx); err == nil && from.Equal(addr) {
+			matches = append(matches, tx)
+		}
 	}
-	if it.Error() != nil {
-		db.Logger().WithField("err", it.Error()).Fatal("Failed to delete bloom bits")
+	return matches
+}
+
+// ReadTransactionsByStatus partitions, in block order, the transactions of a
+// block into those whose receipt reports success and those that failed. The
+// body and receipts are each loaded once, and as the status is stored in the
+// raw receipts no receipt fields are derived. Empty slices are returned if the
+// block body or its receipts are missing or inconsistent.
+func ReadTransactionsByStatus(db ethdb.Reader, number uint64, hash common.Hash) (succeeded, failed []*types.Transaction) {
+	succeeded, failed = make([]*types.Transaction, 0), make([]*types.Transaction, 0)
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return succeeded, failed
+	}
+	txs := body.Transactions()
+	receipts := ReadRawReceipts(db, hash, number)
+	if len(receipts) != len(txs) {
+		db.Logger().WithFields(log.Fields{
+			"hash":     hash,
+			"number":   number,
+			"txs":      len(txs),
+			"receipts": len(receipts),
+		}).Error("Block receipts do not match its transactions")
+		return succeeded, failed
+	}
+	for i, tx := range txs {
+		if receipts[i].Status == types.ReceiptStatusSuccessful {
+			succeeded = append(succeeded, tx)
+		} else {
+			failed = append(failed, tx)
+		}
+	}
+	return succeeded, failed
+}
+
+// ReadBlockSenders retrieves the distinct senders of the transactions of a
+// block, in order of first appearance. Senders are recovered with the given
+// signer, which must match the block's fork; transactions whose sender cannot
+// be recovered are skipped. An empty slice is returned for empty or missing
+// blocks.
+func ReadBlockSenders(db ethdb.Reader, number uint64, hash common.Hash, signer types.Signer) []common.Address {
+	senders := make([]common.Address, 0)
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return senders
+	}
+	seen := make(map[common.AddressBytes]struct{})
+	for _, tx := range body.Transactions() {
+		from, err := types.Sender(signer, tx)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[from.Bytes20()]; ok {
+			continue
+		}
+		seen[from.Bytes20()] = struct{}{}
+		senders = append(senders, from)
+	}
+	return senders
+}
+
+// ReadBlockTotalValue sums the raw Value of the transactions of a block. Only
+// the transactions of the body are summed, so outbound ETXs emitted by the
+// block are not counted, and Qi transactions, whose amounts live in their
+// outputs rather than a value field, are skipped. Zero and false are returned
+// if the block body is missing.
+func ReadBlockTotalValue(db ethdb.Reader, number uint64, hash common.Hash) (*big.Int, bool) {
+	total := new(big.Int)
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return total, false
+	}
+	for _, tx := range body.Transactions() {
+		if tx.Type() == types.QiTxType {
+			continue
+		}
+		total.Add(total, tx.Value())
+	}
+	return total, true
+}
+
+// FirstBlockWithSender returns the number of the first canonical block in the
+// inclusive range [from, to] that includes a transaction sent by sender,
+// stopping at the first hit. No sender index is maintained, so every block up
+// to the hit is loaded and has its senders recovered; callers should keep the
+// range narrow. Missing blocks are skipped.
+func FirstBlockWithSender(db ethdb.Reader, sender common.Address, from, to uint64, signer types.Signer) (uint64, bool) {
+	for number := from; number <= to; number++ {
+		for _, addr := range ReadBlockSenders(db, number, ReadCanonicalHash(db, number), signer) {
+			if addr.Equal(sender) {
+				return number, true
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return 0, false
+}
+
+// ReadTransactionHashes retrieves the hashes of all transactions of a block.
+// Block bodies do not store the hashes separately, so the body is decoded, but
+// the header is never loaded. The number is unused as bodies are keyed by hash
+// alone, and is accepted for symmetry with the other block accessors.
+func ReadTransactionHashes(db ethdb.Reader, number uint64, hash common.Hash) ([]common.Hash, bool) {
+	body := ReadWorkObjectBody(db, hash, types.BlockObject)
+	if body == nil {
+		return nil, false
+	}
+	txs := body.Transactions()
+	hashes := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx.Hash()
+	}
+	return hashes, true
+}
+
+// IsBlockFullyIndexed reports whether every transaction of the given block has
+// a tx lookup entry, returning the hashes of the transactions that do not. A
+// missing block is reported as not indexed, with no missing hashes.
+func IsBlockFullyIndexed(db ethdb.Reader, number uint64, hash common.Hash) (bool, []common.Hash) {
+	hashes, ok := ReadTransactionHashes(db, number, hash)
+	if !ok {
+		return false, nil
+	}
+	var missing []common.Hash
+	for _, txHash := range hashes {
+		if !HasTxLookupEntry(db, txHash) {
+			missing = append(missing, txHash)
+		}
+	}
+	return len(missing) == 0, missing
+}
+
+// CountTransactionsInRange sums the number of transactions of the canonical
+// blocks in the inclusive range [from, to]. If a block in the range is missing,
+// the count accumulated so far is returned together with an error.
+func CountTransactionsInRange(db ethdb.Reader, from, to uint64) (uint64, error) {
+	var count uint64
+	for number := from; number <= to; number++ {
+		wo := readCanonicalWorkObject(db, number)
+		if wo == nil {
+			return count, fmt.Errorf("missing canonical block %d", number)
+		}
+		count += uint64(len(wo.Body().Transactions()))
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return count, nil
+}
+
+// BlockNumberForLogIndex locates the log at the given global index, counted
+// from the first log of block from, within the canonical blocks in the
+// inclusive range [from, to]. The number of the block holding the log and the
+// offset of the log within that block are returned. Only a block without
+// transactions legitimately has no stored receipts; a missing canonical block,
+// a block with transactions but no receipts, or an index beyond the total log
+// count of the range results in an error.
+func BlockNumberForLogIndex(db ethdb.Reader, globalLogIndex uint64, from, to uint64) (uint64, uint64, error) {
+	var total uint64
+	for number := from; number <= to; number++ {
+		hash := ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			return 0, 0, fmt.Errorf("missing canonical block %d", number)
+		}
+		receipts := ReadRawReceipts(db, hash, number)
+		if receipts == nil {
+			hashes, ok := ReadTransactionHashes(db, number, hash)
+			if !ok {
+				return 0, 0, fmt.Errorf("missing body of canonical block %d (%s)", number, hash.Hex())
+			}
+			if len(hashes) > 0 {
+				return 0, 0, fmt.Errorf("missing receipts of canonical block %d (%s)", number, hash.Hex())
+			}
+		}
+		var logs uint64
+		for _, receipt := range receipts {
+			logs += uint64(len(receipt.Logs))
+		}
+		if globalLogIndex < total+logs {
+			return number, globalLogIndex - total, nil
+		}
+		total += logs
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return 0, 0, fmt.Errorf("log index %d beyond the %d logs of range [%d, %d]", globalLogIndex, total, from, to)
+}
+
+// StreamTransactions invokes fn for every transaction of the canonical blocks in
+// the inclusive range [from, to], in chain order, loading each block body only
+// once. Iteration stops early if fn returns false. Missing blocks are skipped
+// with a warning.
+func StreamTransactions(db ethdb.Reader, from, to uint64, fn func(tx *types.Transaction, blockNumber, index uint64) bool) error {
+	if from > to {
+		return fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	for number := from; number <= to; number++ {
+		wo := readCanonicalWorkObject(db, number)
+		if wo == nil {
+			db.Logger().WithField("number", number).Warn("Skipping missing block while streaming transactions")
+		} else {
+			for i, tx := range wo.Body().Transactions() {
+				if !fn(tx, number, uint64(i)) {
+					return nil
+				}
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return nil
+}
+
+// StreamTxLookupByBlockOrder invokes fn with the hash and block number of every
+// transaction of the canonical blocks in the inclusive range [from, to], in
+// block number order. This yields the view of the tx lookup index derived from
+// the canonical chain, rather than the hash order of the raw index. Iteration
+// stops early if fn returns false. Missing blocks are skipped with a warning.
+func StreamTxLookupByBlockOrder(db ethdb.Reader, from, to uint64, fn func(hash common.Hash, number uint64) bool) error {
+	if from > to {
+		return fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	for number := from; number <= to; number++ {
+		hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number))
+		if !ok {
+			db.Logger().WithField("number", number).Warn("Skipping missing block while streaming tx lookups")
+		}
+		for _, hash := range hashes {
+			if !fn(hash, number) {
+				return nil
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return nil
+}
+
+// ReadRecentTransactions collects up to n transactions walking the canonical
+// chain backwards from head, newest first, returning them together with the
+// number of the block each was included in. The walk stops at the genesis block
+// or at the first missing canonical block.
+func ReadRecentTransactions(db ethdb.Reader, head uint64, n int) ([]*types.Transaction, []uint64) {
+	var (
+		txs     []*types.Transaction
+		numbers []uint64
+	)
+	for number := head; len(txs) < n; number-- {
+		wo := readCanonicalWorkObject(db, number)
+		if wo == nil {
+			break
+		}
+		blockTxs := wo.Body().Transactions()
+		for i := len(blockTxs) - 1; i >= 0 && len(txs) < n; i-- {
+			txs = append(txs, blockTxs[i])
+			numbers = append(numbers, number)
+		}
+		if number == 0 {
+			break
+		}
+	}
+	return txs, numbers
+}
+
+// EstimateTransactionBlockBound returns the earliest block in which a
+// transaction from sender with the given nonce could have been included, for
+// narrowing a fallback block scan when its lookup entry is missing. The
+// database does not track per account nonce history, so no bound can be derived
+// and ok is always false; callers must scan from the genesis block.
+func EstimateTransactionBlockBound(db ethdb.Reader, sender common.Address, nonce uint64) (minBlock uint64, ok bool) {
+	return 0, false
+}
+
+// FindTransactionInBlocks scans the canonical blocks at the candidate numbers
+// for a transaction without consulting the tx lookup index, returning the first
+// match along with its block number and index. This is meant for recovery when
+// the index itself is suspect. Zeros are returned if no candidate contains it.
+func FindTransactionInBlocks(db ethdb.Reader, hash common.Hash, numbers []uint64) (*types.Transaction, uint64, uint64) {
+	for _, number := range numbers {
+		wo := readCanonicalWorkObject(db, number)
+		if wo == nil {
+			continue
+		}
+		for txIndex, tx := range wo.Body().Transactions() {
+			if tx.Hash() == hash {
+				return tx, number, uint64(txIndex)
+			}
+		}
+	}
+	return nil, 0, 0
+}
+
+// ErrTxNotFound is returned when a transaction cannot be resolved through the
+// tx lookup index.
+var ErrTxNotFound = errors.New("transaction not found")
+
+// TxLocation groups a transaction with the positional metadata resolved for
+// it by ReadTransaction.
+type TxLocation struct {
+	Tx          *types.Transaction
+	BlockHash   common.Hash
+	BlockNumber uint64
+	Index       uint64
+}
+
+// MustReadTransaction is a wrapper around ReadTransaction that either returns a
+// fully populated TxLocation or ErrTxNotFound, never a partially zeroed result.
+func MustReadTransaction(db ethdb.Reader, hash common.Hash) (*TxLocation, error) {
+	tx, blockHash, blockNumber, index := ReadTransaction(db, hash)
+	if tx == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTxNotFound, hash.Hex())
+	}
+	return &TxLocation{
+		Tx:          tx,
+		BlockHash:   blockHash,
+		BlockNumber: blockNumber,
+		Index:       index,
+	}, nil
+}
+
+// ReadTransactionPosition retrieves the block number and the index within the
+// block of a transaction. Legacy v3 lookup entries encode the index directly,
+// in which case no block body is loaded; for every other format the position
+// is resolved by scanning the canonical block body.
+func ReadTransactionPosition(db ethdb.Reader, hash common.Hash) (uint64, uint64, bool) {
+	data, _ := db.Get(txLookupKey(hash))
+	if len(data) == 0 {
+		return 0, 0, false
+	}
+	if len(data) > common.HashLength && len(data) <= maxLegacyTxLookupEntryLength {
+		protoLegacyTxLookupEntry := new(ProtoLegacyTxLookupEntry)
+		if err := proto.Unmarshal(data, protoLegacyTxLookupEntry); err == nil {
+			entry := new(LegacyTxLookupEntry)
+			entry.ProtoDecode(protoLegacyTxLookupEntry)
+			return entry.BlockIndex, entry.Index, true
+		}
+	}
+	tx, _, blockNumber, txIndex := ReadTransaction(db, hash)
+	if tx == nil {
+		return 0, 0, false
+	}
+	return blockNumber, txIndex, true
+}
+
+// txLookupRecordLength is the size of a (hash, block number) record produced by
+// SnapshotTxLookupRange.
+const txLookupRecordLength = common.HashLength + 8
+
+// readCanonicalWorkObject retrieves the canonical block with the given number,
+// or nil if either the canonical hash or the block itself is missing.
+func readCanonicalWorkObject(db ethdb.Reader, number uint64) *types.WorkObject {
+	blockHash := ReadCanonicalHash(db, number)
+	if blockHash == (common.Hash{}) {
+		return nil
+	}
+	return ReadWorkObject(db, number, blockHash, types.BlockObject)
+}
+
+// TxLookupCoverageGaps walks the canonical blocks in the inclusive range
+// [from, to] and returns the contiguous [start, end] ranges of blocks in which
+// no transaction has a tx lookup entry. Empty blocks have nothing to index and
+// are never counted as gaps, so they end any gap in progress. Missing blocks
+// are skipped, ending any gap in progress too, and are reported together in an
+// error returned alongside the gaps found.
+func TxLookupCoverageGaps(db ethdb.Reader, from, to uint64) ([][2]uint64, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid range [%d, %d]", from, to)
+	}
+	var (
+		gaps    [][2]uint64
+		missing []uint64
+		inGap   bool
+	)
+	for number := from; number <= to; number++ {
+		hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number))
+		if !ok {
+			missing = append(missing, number)
+		}
+		unindexed := len(hashes) > 0
+		for _, hash := range hashes {
+			if HasTxLookupEntry(db, hash) {
+				unindexed = false
+				break
+			}
+		}
+		switch {
+		case unindexed && inGap:
+			gaps[len(gaps)-1][1] = number
+		case unindexed:
+			gaps = append(gaps, [2]uint64{number, number})
+		}
+		inGap = unindexed
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	if len(missing) > 0 {
+		return gaps, fmt.Errorf("missing canonical blocks %v", missing)
+	}
+	return gaps, nil
+}
+
+// TxLookupEntriesSince returns the (hash, number) tx lookup pairs of the
+// canonical blocks in the range [sinceBlock+1, to], so that downstream indexers
+// can pull the entries added since a checkpoint, typically a previous
+// ReadTxIndexHighWater. The pairs are derived from the canonical chain rather
+// than the raw index, which carries no timestamps. A missing canonical block
+// results in an error.
+func TxLookupEntriesSince(db ethdb.Reader, sinceBlock uint64, to uint64) (map[common.Hash]uint64, error) {
+	entries := make(map[common.Hash]uint64)
+	if sinceBlock >= to {
+		return entries, nil
+	}
+	for number := sinceBlock + 1; number <= to; number++ {
+		hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number))
+		if !ok {
+			return nil, fmt.Errorf("missing canonical block %d", number)
+		}
+		for _, hash := range hashes {
+			entries[hash] = number
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// FindDuplicateTransactions walks the canonical blocks in the inclusive range
+// [from, to] and returns every transaction hash included in more than one block,
+// mapped to the numbers of those blocks in ascending order. Such duplicates are
+// masked by the single valued tx lookup index and indicate corruption. Every
+// transaction hash in the range is held in memory during the walk, so large
+// ranges should be audited in chunks. Missing blocks are skipped.
+func FindDuplicateTransactions(db ethdb.Reader, from, to uint64) (map[common.Hash][]uint64, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range [%d, %d]", from, to)
+	}
+	seen := make(map[common.Hash][]uint64)
+	for number := from; number <= to; number++ {
+		if hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number)); ok {
+			for _, hash := range hashes {
+				if blocks := seen[hash]; len(blocks) == 0 || blocks[len(blocks)-1] != number {
+					seen[hash] = append(blocks, number)
+				}
+			}
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	duplicates := make(map[common.Hash][]uint64)
+	for hash, blocks := range seen {
+		if len(blocks) > 1 {
+			duplicates[hash] = blocks
+		}
+	}
+	return duplicates, nil
+}
+
+// SnapshotTxLookupRange writes the tx lookup entries of the canonical blocks in
+// the inclusive range [from, to] to w as fixed size hash || number (uint64 big
+// endian) records. Only transactions whose lookup entry points at their block
+// are written; missing blocks are skipped. The number of records is returned.
+func SnapshotTxLookupRange(db ethdb.Reader, from, to uint64, w io.Writer) (int, error) {
+	count := 0
+	record := make([]byte, txLookupRecordLength)
+	for number := from; number <= to; number++ {
+		hashes, ok := ReadTransactionHashes(db, number, ReadCanonicalHash(db, number))
+		if !ok {
+			continue
+		}
+		for _, hash := range hashes {
+			if entry := ReadTxLookupEntry(db, hash); entry == nil || *entry != number {
+				continue
+			}
+			copy(record, hash.Bytes())
+			binary.BigEndian.PutUint64(record[common.HashLength:], number)
+			if _, err := w.Write(record); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	return count, nil
+}
+
+// RestoreTxLookupRange re-applies tx lookup entries previously written by
+// SnapshotTxLookupRange, returning the number of entries restored.
+func RestoreTxLookupRange(db ethdb.KeyValueWriter, r io.Reader) (int, error) {
+	count := 0
+	record := make([]byte, txLookupRecordLength)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return count, nil
+			}
+			return count, err
+		}
+		number := binary.BigEndian.Uint64(record[common.HashLength:])
+		writeTxLookupEntry(db, common.BytesToHash(record[:common.HashLength]), new(big.Int).SetUint64(number).Bytes())
+		count++
+	}
+}
+
+// ReadBloomBits retrieves the compressed bloom bit vector belonging to the given
+// section and bit index from the.
+func ReadBloomBits(db ethdb.KeyValueReader, bit uint, section uint64, head common.Hash) ([]byte, error) {
+	return db.Get(bloomBitsKey(bit, section, head))
+}
+
+// ReadBloomBitsWithFallback retrieves the compressed bloom bit vector belonging
+// to the given section and bit index, trying each of the supplied heads in order
+// and returning the first hit along with the head it was stored under. This
+// allows callers to fall back to the bits of a recent ancestor while the bits of
+// the current head have not been computed yet.
+func ReadBloomBitsWithFallback(db ethdb.KeyValueReader, bit uint, section uint64, heads []common.Hash) ([]byte, common.Hash, error) {
+	for _, head := range heads {
+		bits, err := ReadBloomBits(db, bit, section, head)
+		if err == nil && len(bits) > 0 {
+			return bits, head, nil
+		}
+	}
+	return nil, common.Hash{}, fmt.Errorf("no bloom bits for bit %d section %d under %d heads", bit, section, len(heads))
+}
+
+// maxBloomBitsRangeSections is the largest number of sections ReadBloomBitsRange
+// reads at once, bounding the result allocated for a caller supplied range.
+const maxBloomBitsRangeSections = 4096
+
+// ReadBloomBitsRange retrieves the compressed bloom bit vectors belonging to the
+// given bit index and head for every section in [from, to) using a single
+// iterator pass. The result is indexed by section offset from the start of the
+// range, with nil entries for sections that have no bits stored. Ranges wider
+// than maxBloomBitsRangeSections are rejected and must be read in chunks.
+func ReadBloomBitsRange(db ethdb.Iteratee, bit uint, from, to uint64, head common.Hash) ([][]byte, error) {
+	if to < from {
+		return nil, fmt.Errorf("invalid section range [%d, %d)", from, to)
+	}
+	if to-from > maxBloomBitsRangeSections {
+		return nil, fmt.Errorf("section range [%d, %d) exceeds %d sections", from, to, maxBloomBitsRangeSections)
+	}
+	result := make([][]byte, to-from)
+	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
+	it := db.NewIterator(nil, start)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if len(key) != BloomBitsKeyLength || !bytes.Equal(key[len(key)-common.HashLength:], head.Bytes()) {
+			continue
+		}
+		section := binary.BigEndian.Uint64(key[len(BloomBitsPrefix)+2:])
+		result[section-from] = common.CopyBytes(it.Value())
+	}
+	return result, it.Error()
+}
+
+// WriteBloomBits stores the compressed bloom bits vector belonging to the given
+// section and bit index.
+func WriteBloomBits(db ethdb.KeyValueWriter, bit uint, section uint64, head common.Hash, bits []byte) {
+	if err := db.Put(bloomBitsKey(bit, section, head), bits); err != nil {
+		db.Logger().WithField("err", err).Fatal("Failed to store bloom bits")
+	}
+}
+
+// WriteBloomBitsAuto compresses and stores an uncompressed bloom bits vector
+// belonging to the given section and bit index. Vectors which do not shrink
+// under compression are stored verbatim, as bitutil.CompressBytes already falls
+// back to a raw copy and bitutil.DecompressBytes recognises one by its length,
+// so the blobs stay readable by every existing bloom bits consumer.
+func WriteBloomBitsAuto(db ethdb.KeyValueWriter, bit uint, section uint64, head common.Hash, raw []byte) {
+	WriteBloomBits(db, bit, section, head, bitutil.CompressBytes(raw))
+}
+
+// ReadBloomBitsAuto retrieves the bloom bits vector belonging to the given
+// section and bit index, returning it uncompressed. The size is the length of
+// the uncompressed vector in bytes.
+func ReadBloomBitsAuto(db ethdb.KeyValueReader, bit uint, section uint64, head common.Hash, size int) ([]byte, error) {
+	data, err := ReadBloomBits(db, bit, section, head)
+	if err != nil {
+		return nil, err
+	}
+	return bitutil.DecompressBytes(data, size)
+}
+
+// DeleteBloombits removes all compressed bloom bits vector belonging to the
+// given section range and bit index.
+func DeleteBloombits(db ethdb.Database, bit uint, from uint64, to uint64) {
+	DeleteBloombitsLimited(db, bit, from, to, 0)
+}
+
+// DeleteBloombitsLimited removes at most max compressed bloom bits vectors
+// belonging to the given section range and bit index, so that background
+// cleanups can spread the work over several calls. It returns the number of
+// vectors deleted, the section to resume from and whether the range has been
+// fully processed. A max of zero removes the whole range.
+func DeleteBloombitsLimited(db ethdb.Database, bit uint, from, to uint64, max int) (deleted int, nextFrom uint64, done bool) {
+	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
+	it := db.NewIterator(nil, start)
+	defer it.Release()
+
+	for it.Next() {
+		if bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+		if len(it.Key()) != BloomBitsKeyLength {
+			continue
+		}
+		if max > 0 && deleted >= max {
+			return deleted, binary.BigEndian.Uint64(it.Key()[len(BloomBitsPrefix)+2:]), false
+		}
+		db.Delete(it.Key())
+		deleted++
+	}
+	if it.Error() != nil {
+		db.Logger().WithField("err", it.Error()).Fatal("Failed to delete bloom bits")
+	}
+	return deleted, to, true
+}
+
+// PopulatedBloomBits returns the sorted set of distinct bloom bit indices that
+// have at least one compressed bloom bits vector stored. Once a bit index is
+// found the iteration skips straight to the next index, so the cost scales with
+// the number of populated indices rather than the number of stored sections.
+func PopulatedBloomBits(db ethdb.Iteratee) []uint {
+	var (
+		bits  []uint
+		start = BloomBitsPrefix
+	)
+	for {
+		it := db.NewIterator(nil, start)
+		found := false
+		for it.Next() {
+			key := it.Key()
+			if !bytes.HasPrefix(key, BloomBitsPrefix) {
+				break
+			}
+			if len(key) != BloomBitsKeyLength {
+				continue
+			}
+			found = true
+			bit := uint(binary.BigEndian.Uint16(key[len(BloomBitsPrefix):]))
+			bits = append(bits, bit)
+			if bit == math.MaxUint16 {
+				it.Release()
+				return bits
+			}
+			start = bloomBitsKey(bit+1, 0, common.Hash{})
+			break
+		}
+		it.Release()
+		if !found {
+			return bits
+		}
+	}
+}
+
+// BloomBitHeadsForSection returns the head hashes under which a compressed
+// bloom bits vector is stored for the given bit index and section. More than
+// one head indicates vectors left behind by reorgs. Malformed keys are skipped.
+func BloomBitHeadsForSection(db ethdb.Iteratee, bit uint, section uint64) []common.Hash {
+	prefix := bloomBitsKey(bit, section, common.Hash{})[:BloomBitsKeyLength-common.HashLength]
+	it := db.NewIterator(prefix, nil)
+	defer it.Release()
+
+	var heads []common.Hash
+	for it.Next() {
+		key := it.Key()
+		if len(key) != BloomBitsKeyLength {
+			continue
+		}
+		heads = append(heads, common.BytesToHash(key[len(prefix):]))
+	}
+	return heads
+}
+
+// CopyBloomBits copies all compressed bloom bits vectors belonging to the given
+// section range and bit index from src into dst, preserving the head hash each
+// vector was stored under. If dst supports batching, the writes are flushed in
+// batches of ethdb.IdealBatchSize.
+func CopyBloomBits(src ethdb.Iteratee, dst ethdb.KeyValueWriter, bit uint, from, to uint64) (int, error) {
+	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
+	it := src.NewIterator(nil, start)
+	defer it.Release()
+
+	var (
+		writer = dst
+		batch  ethdb.Batch
+	)
+	if batcher, ok := dst.(ethdb.Batcher); ok {
+		batch = batcher.NewBatch()
+		writer = batch
+	}
+	copied := 0
+	for it.Next() {
+		if bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+		if len(it.Key()) != BloomBitsKeyLength {
+			continue
+		}
+		if err := writer.Put(common.CopyBytes(it.Key()), common.CopyBytes(it.Value())); err != nil {
+			return copied, err
+		}
+		copied++
+		if batch != nil && batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return copied, err
+			}
+			batch.Reset()
+		}
+	}
+	if err := it.Error(); err != nil {
+		return copied, err
+	}
+	if batch != nil {
+		if err := batch.Write(); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// SectionsWithBitSet returns the sections in the range [from, to) whose bloom
+// bits vector for the given bit index, stored under head, has any bit set. The
+// vectors are decompressed assuming the standard section size of
+// params.BloomBitsBlocks blocks; sections indexed with a different size fail to
+// decompress and abort the scan with an error. Missing sections are skipped.
+func SectionsWithBitSet(db ethdb.Iteratee, bit uint, from, to uint64, head common.Hash) ([]uint64, error) {
+	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
+	it := db.NewIterator(nil, start)
+	defer it.Release()
+
+	var sections []uint64
+	for it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if len(key) != BloomBitsKeyLength || common.BytesToHash(key[BloomBitsKeyLength-common.HashLength:]) != head {
+			continue
+		}
+		section := binary.BigEndian.Uint64(key[len(BloomBitsPrefix)+2:])
+		bits, err := bitutil.DecompressBytes(it.Value(), int(params.BloomBitsBlocks/8))
+		if err != nil {
+			return sections, fmt.Errorf("section %d: %w", section, err)
+		}
+		if !bitutil.TestBytes(bits) {
+			continue
+		}
+		sections = append(sections, section)
+	}
+	return sections, it.Error()
+}
+
+// ValidateBloomBits checks that a compressed bloom bits vector decompresses to
+// exactly one bit per block of a section of the given size.
+func ValidateBloomBits(data []byte, sectionSize uint64) error {
+	if sectionSize == 0 || sectionSize%8 != 0 {
+		return fmt.Errorf("invalid section size %d", sectionSize)
+	}
+	bits, err := bitutil.DecompressBytes(data, int(sectionSize/8))
+	if err != nil {
+		return err
+	}
+	if uint64(len(bits)) != sectionSize/8 {
+		return fmt.Errorf("decompressed to %d bytes, want %d", len(bits), sectionSize/8)
+	}
+	return nil
+}
+
+// VerifyBloomBitsDecompression checks every compressed bloom bits vector of the
+// given bit index stored under head for the sections in the range [from, to)
+// with ValidateBloomBits, in a single iterator pass, and returns the sections
+// whose vector is corrupt. Missing sections are not reported.
+func VerifyBloomBitsDecompression(db ethdb.Iteratee, bit uint, from, to uint64, head common.Hash, sectionSize uint64) ([]uint64, error) {
+	if sectionSize == 0 || sectionSize%8 != 0 {
+		return nil, fmt.Errorf("invalid section size %d", sectionSize)
+	}
+	start, end := bloomBitsKey(bit, from, common.Hash{}), bloomBitsKey(bit, to, common.Hash{})
+	it := db.NewIterator(nil, start)
+	defer it.Release()
+
+	var corrupt []uint64
+	for it.Next() {
+		key := it.Key()
+		if bytes.Compare(key, end) >= 0 {
+			break
+		}
+		if len(key) != BloomBitsKeyLength || common.BytesToHash(key[BloomBitsKeyLength-common.HashLength:]) != head {
+			continue
+		}
+		if ValidateBloomBits(it.Value(), sectionSize) != nil {
+			corrupt = append(corrupt, binary.BigEndian.Uint64(key[len(BloomBitsPrefix)+2:]))
+		}
+	}
+	return corrupt, it.Error()
+}
+
+// RekeyBloomBits moves the compressed bloom bits vectors of every bit index in
+// the section range [from, to) from oldHead to newHead, saving a recomputation
+// when the section contents are unchanged. Each section is moved in a single
+// batch, so an interrupted migration leaves every section either fully moved
+// or untouched. The number of vectors moved is returned.
+func RekeyBloomBits(db ethdb.Database, oldHead, newHead common.Hash, from, to uint64) (int, error) {
+	if oldHead == newHead {
+		return 0, nil
+	}
+	bits := PopulatedBloomBits(db)
+	moved := 0
+	for section := from; section < to; section++ {
+		batch := db.NewBatch()
+		count := 0
+		for _, bit := range bits {
+			data, err := ReadBloomBits(db, bit, section, oldHead)
+			if err != nil || len(data) == 0 {
+				continue
+			}
+			if err := batch.Put(bloomBitsKey(bit, section, newHead), data); err != nil {
+				return moved, err
+			}
+			if err := batch.Delete(bloomBitsKey(bit, section, oldHead)); err != nil {
+				return moved, err
+			}
+			count++
+		}
+		if count == 0 {
+			continue
+		}
+		if err := batch.Write(); err != nil {
+			return moved, err
+		}
+		moved += count
+	}
+	return moved, nil
+}
+
+// RecomputeBloomBitsForSection rebuilds the compressed bloom bits vectors of a
+// single section from the blooms of its canonical blocks and stores them under
+// the given head, for surgically repairing a corrupt section without rerunning
+// the whole bloom indexer. Like the indexer, it consumes the stored per-block
+// blooms, and only derives a bloom from the receipts of blocks which have none.
+// The section must be fully populated with canonical blocks, and every block
+// with transactions must have either a bloom or its receipts, otherwise nothing
+// is written and an error is returned.
+func RecomputeBloomBitsForSection(db ethdb.Database, section uint64, head common.Hash, sectionSize uint64, config *params.ChainConfig) error {
+	gen, err := bloombits.NewGenerator(uint(sectionSize))
+	if err != nil {
+		return err
+	}
+	start := section * sectionSize
+	for i := uint64(0); i < sectionSize; i++ {
+		number := start + i
+		hash := ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			return fmt.Errorf("section %d incomplete: missing canonical block %d", section, number)
+		}
+		if ReadHeaderNumber(db, hash) == nil {
+			return fmt.Errorf("section %d incomplete: missing header %d (%s)", section, number, hash.Hex())
+		}
+		bloom := ReadBloom(db, hash)
+		if bloom == nil {
+			receipts := ReadReceipts(db, hash, number, config)
+			if receipts == nil {
+				// Only a block without transactions legitimately has no receipts
+				hashes, ok := ReadTransactionHashes(db, number, hash)
+				if !ok {
+					return fmt.Errorf("section %d incomplete: missing body %d (%s)", section, number, hash.Hex())
+				}
+				if len(hashes) > 0 {
+					return fmt.Errorf("section %d incomplete: missing bloom and receipts %d (%s)", section, number, hash.Hex())
+				}
+			}
+			created := types.CreateBloom(receipts)
+			bloom = &created
+		}
+		if err := gen.AddBloom(uint(i), *bloom); err != nil {
+			return err
+		}
+	}
+	batch := db.NewBatch()
+	for i := 0; i < types.BloomBitLength; i++ {
+		bits, err := gen.Bitset(uint(i))
+		if err != nil {
+			return err
+		}
+		WriteBloomBits(batch, uint(i), section, head, bitutil.CompressBytes(bits))
+	}
+	return batch.Write()
+}
+
+// EntropyQuantiles returns the requested quantiles of the LogBig entropy
+// distribution of the canonical block difficulties in the inclusive range
+// [from, to]. Quantiles are selected by nearest rank over the sorted samples
+// and returned as the difficulty of the selected block, so no precision is lost
+// converting the entropy back. Missing blocks are skipped.
+func EntropyQuantiles(db ethdb.Reader, from, to uint64, quantiles []float64) ([]*big.Int, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range [%d, %d]", from, to)
+	}
+	for _, q := range quantiles {
+		if math.IsNaN(q) || q < 0 || q > 1 {
+			return nil, fmt.Errorf("quantile %v out of range [0, 1]", q)
+		}
+	}
+	type sample struct {
+		entropy    *big.Int
+		difficulty *big.Int
+	}
+	var samples []sample
+	for number := from; number <= to; number++ {
+		block := readCanonicalWorkObject(db, number)
+		if block != nil && common.IsValidDifficulty(block.Difficulty()) {
+			samples = append(samples, sample{common.LogBig(block.Difficulty()), new(big.Int).Set(block.Difficulty())})
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no block difficulties in range [%d, %d]", from, to)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].entropy.Cmp(samples[j].entropy) < 0
+	})
+	result := make([]*big.Int, len(quantiles))
+	for i, q := range quantiles {
+		rank := int(math.Round(q * float64(len(samples)-1)))
+		result[i] = new(big.Int).Set(samples[rank].difficulty)
+	}
+	return result, nil
+}
+
+// EntropyMeanStdDev returns the mean and population standard deviation, in
+// big-bits, of the LogBig entropies of the canonical block difficulties in the
+// inclusive range [from, to]. Missing blocks are skipped, and an error is
+// returned if the range holds no block difficulties.
+func EntropyMeanStdDev(db ethdb.Reader, from, to uint64) (mean, stddev *big.Float, err error) {
+	if from > to {
+		return nil, nil, fmt.Errorf("invalid block range [%d, %d]", from, to)
+	}
+	var (
+		sum, sumSquares = new(big.Int), new(big.Int)
+		count           int64
+	)
+	for number := from; number <= to; number++ {
+		block := readCanonicalWorkObject(db, number)
+		if block != nil && common.IsValidDifficulty(block.Difficulty()) {
+			entropy := common.LogBig(block.Difficulty())
+			sum.Add(sum, entropy)
+			sumSquares.Add(sumSquares, entropy.Mul(entropy, entropy))
+			count++
+		}
+		if number == math.MaxUint64 {
+			break
+		}
+	}
+	if count == 0 {
+		return nil, nil, fmt.Errorf("no block difficulties in range [%d, %d]", from, to)
 	}
+	// Var = (n*sum(x^2) - sum(x)^2) / n^2, evaluated exactly in integers
+	n := big.NewInt(count)
+	variance := new(big.Int).Sub(new(big.Int).Mul(n, sumSquares), new(big.Int).Mul(sum, sum))
+	const prec = 256
+	mean = new(big.Float).SetPrec(prec).Quo(new(big.Float).SetPrec(prec).SetInt(sum), new(big.Float).SetInt(n))
+	stddev = new(big.Float).SetPrec(prec).SetInt(variance)
+	stddev.Sqrt(stddev).Quo(stddev, new(big.Float).SetInt(n))
+	return mean, stddev, nil
 }
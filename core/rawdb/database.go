@@ -407,6 +407,10 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte, logger *log.
 			codes.Add(size)
 		case bytes.HasPrefix(key, txLookupPrefix) && len(key) == (len(txLookupPrefix)+common.HashLength):
 			txLookups.Add(size)
+		case bytes.HasPrefix(key, txLookupListPrefix) && len(key) > (len(txLookupListPrefix)+common.HashLength):
+			txLookups.Add(size)
+		case bytes.HasPrefix(key, txReorgedPrefix) && len(key) == (len(txReorgedPrefix)+common.HashLength):
+			txLookups.Add(size)
 		case bytes.HasPrefix(key, SnapshotAccountPrefix) && len(key) == (len(SnapshotAccountPrefix)+common.HashLength):
 			accountSnaps.Add(size)
 		case bytes.HasPrefix(key, SnapshotStoragePrefix) && len(key) == (len(SnapshotStoragePrefix)+2*common.HashLength):
@@ -433,7 +437,7 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte, logger *log.
 				databaseVersionKey, headHeaderKey, headWorkObjectKey,
 				snapshotDisabledKey, snapshotRootKey, snapshotJournalKey,
 				snapshotGeneratorKey, snapshotRecoveryKey,
-				uncleanShutdownKey,
+				uncleanShutdownKey, txIndexHighWaterKey,
 			} {
 				if bytes.Equal(key, meta) {
 					metadata.Add(size)
@@ -66,6 +66,9 @@ var (
 	// genesisHashesKey tracks the list of genesis hashes
 	genesisHashesKey = []byte("GenesisHashes")
 
+	// txIndexHighWaterKey tracks the highest block number whose transactions were indexed.
+	txIndexHighWaterKey = []byte("TxIndexHighWater")
+
 	lastTrimmedBlockPrefix = []byte("ltb")
 
 	// Data item prefixes (use single byte to avoid mixing data types, avoid `i`, used for indexes).
@@ -102,6 +105,8 @@ var (
 	manifestPrefix          = []byte("ma")    // manifestPrefix + hash -> Manifest at block
 	interlinkPrefix         = []byte("il")    // interlinkPrefix + hash -> Interlink at block
 	bloomPrefix             = []byte("bl")    // bloomPrefix + hash -> bloom at block
+	txReorgedPrefix         = []byte("xr")    // txReorgedPrefix + hash -> block number (uint64 big endian) of the reorg that removed the tx
+	txLookupListPrefix      = []byte("xl")    // txLookupListPrefix + hash + lookup value -> nil, one key per lookup entry in multi-value mode
 
 	txLookupPrefix        = []byte("l") // txLookupPrefix + hash -> transaction/receipt lookup metadata
 	BloomBitsPrefix       = []byte("B") // bloomBitsPrefix + bit (uint16 big endian) + section (uint64 big endian) + hash -> bloom bits
@@ -228,6 +233,16 @@ func txLookupKey(hash common.Hash) []byte {
 	return append(txLookupPrefix, hash.Bytes()...)
 }
 
+// txLookupListKey = txLookupListPrefix + hash + lookup value
+func txLookupListKey(hash common.Hash, value []byte) []byte {
+	return append(append(txLookupListPrefix, hash.Bytes()...), value...)
+}
+
+// txReorgedKey = txReorgedPrefix + hash
+func txReorgedKey(hash common.Hash) []byte {
+	return append(txReorgedPrefix, hash.Bytes()...)
+}
+
 // accountSnapshotKey = SnapshotAccountPrefix + hash
 func accountSnapshotKey(hash common.Hash) []byte {
 	return append(SnapshotAccountPrefix, hash.Bytes()...)